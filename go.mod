@@ -2,17 +2,21 @@ module github.com/everpeace/ssh-agent-multiplexer
 
 go 1.19
 
-require golang.org/x/crypto v0.0.0-20220926161630-eccd6366d1be
+require (
+	github.com/Microsoft/go-winio v0.6.0
+	github.com/fsnotify/fsnotify v1.6.0
+	golang.org/x/crypto v0.0.0-20220926161630-eccd6366d1be
+)
 
 require (
-	github.com/hashicorp/errwrap v1.0.0 // indirect
-	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
+	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
+	golang.org/x/tools v0.1.12 // indirect
 )
 
 require (
 	github.com/rs/zerolog v1.28.0
 	github.com/spf13/pflag v1.0.5
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956
 )
@@ -0,0 +1,42 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListenAbstractSocket(t *testing.T) {
+	path := fmt.Sprintf("@ssh-agent-multiplexer-test-%d", os.Getpid())
+	if err := ensureSocketDir(path, 0o700); err != nil {
+		t.Fatalf("expected no directory for the abstract socket, got %v", err)
+	}
+	if resolved := resolvePath(path); resolved != path {
+		t.Errorf("expected the abstract socket path kept as is, got %s", resolved)
+	}
+
+	l, err := listenSocket(context.Background(), path)
+	if err != nil {
+		t.Fatalf("failed to listen on the abstract socket: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect to the abstract socket: %v", err)
+	}
+	_ = c.Close()
+
+	// no file to remove even when some process listens on it
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("expected stale socket removal to skip the abstract socket, got %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no file for the abstract socket, got %v", err)
+	}
+}
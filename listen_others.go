@@ -0,0 +1,63 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+const staleSocketDialTimeout = time.Second
+
+// listenSocket listens on a unix socket. Named pipes are supported only on Windows.
+func listenSocket(ctx context.Context, listen string) (net.Listener, error) {
+	if strings.HasPrefix(listen, npipePrefix) {
+		return nil, fmt.Errorf("named pipe is supported only on windows: %s", listen)
+	}
+	if err := removeStaleSocket(listen); err != nil {
+		return nil, err
+	}
+	return (&net.ListenConfig{}).Listen(ctx, "unix", listen)
+}
+
+// removeStaleSocket removes the socket file at path left by a dead process.
+// It refuses to remove the socket when some process still accepts connections on it.
+func removeStaleSocket(path string) error {
+	if pkg.IsAbstractSocket(path) {
+		// abstract sockets vanish with the process listening on them
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleSocketDialTimeout)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("address already in use: another instance is listening on %s", path)
+	}
+
+	log.Info().Str("path", path).Msg("Removing the stale socket")
+	return os.Remove(path)
+}
@@ -0,0 +1,80 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(testDir(t), "mux.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leave the socket file behind like a crashed process
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("expected the stale socket to be removed, got %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale socket removed, got %v", err)
+	}
+
+	l, err = listenSocket(context.Background(), path)
+	if err != nil {
+		t.Fatalf("expected to listen on the path, got %v", err)
+	}
+	_ = l.Close()
+}
+
+func TestRemoveStaleSocketRefusesLiveSocket(t *testing.T) {
+	path := filepath.Join(testDir(t), "mux.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("expected an error for the socket with a live listener")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("expected the live socket kept, got %v", err)
+	}
+}
+
+func TestRemoveStaleSocketRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(testDir(t), "mux.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Fatal("expected an error for the file which is not a socket")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("expected the file kept, got %v", err)
+	}
+}
+
+func TestListenSocketOfLongestPath(t *testing.T) {
+	path := socketPathOfLen(t, testDir(t), maxSocketPathLen-1)
+	if err := validateSocketPath(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenSocket(context.Background(), path)
+	if err != nil {
+		t.Fatalf("expected to listen on the path passing validation, got %v", err)
+	}
+	_ = l.Close()
+}
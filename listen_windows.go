@@ -0,0 +1,29 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// pipeSecurityDescriptor allows only the owner to connect to the named pipe. The default one allows everyone to read it.
+// "D:P" is a protected DACL not inheriting the default one and "(A;;GA;;;OW)" grants all access to the owner.
+const pipeSecurityDescriptor = "D:P(A;;GA;;;OW)"
+
+// listenSocket listens on a named pipe when listen starts with npipePrefix
+// (e.g. npipe://./pipe/openssh-ssh-agent for \\.\pipe\openssh-ssh-agent), otherwise on a unix socket.
+func listenSocket(ctx context.Context, listen string) (net.Listener, error) {
+	if strings.HasPrefix(listen, npipePrefix) {
+		pipe := `\\` + strings.ReplaceAll(strings.TrimPrefix(listen, npipePrefix), "/", `\`)
+		return winio.ListenPipe(pipe, &winio.PipeConfig{SecurityDescriptor: pipeSecurityDescriptor})
+	}
+	return (&net.ListenConfig{}).Listen(ctx, "unix", listen)
+}
@@ -0,0 +1,16 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenFromFd(fd int) (net.Listener, error) {
+	return nil, errors.New("listen-fd is not supported on this platform")
+}
@@ -0,0 +1,30 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFromFd returns the listener of the pre-opened listening socket fd (e.g. passed by inetd).
+func listenFromFd(fd int) (net.Listener, error) {
+	accepting, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d is not a socket: %w", fd, err)
+	}
+	if accepting == 0 {
+		return nil, fmt.Errorf("fd %d is not a listening socket", fd)
+	}
+
+	f := os.NewFile(uintptr(fd), "listen")
+	defer f.Close()
+	return net.FileListener(f)
+}
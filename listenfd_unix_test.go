@@ -0,0 +1,85 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dupFd returns a duplicate of the file descriptor of l which the caller owns.
+func dupFd(t *testing.T, l *net.UnixListener) int {
+	t.Helper()
+	file, err := l.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestListenFromFdServesListeningSocket(t *testing.T) {
+	path := filepath.Join(testDir(t), "mux.sock")
+	orig, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	l, err := listenFromFd(dupFd(t, orig.(*net.UnixListener)))
+	if err != nil {
+		t.Fatalf("expected the listening socket accepted, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, l, newTestMux(t, agent.NewKeyring()), serveOptions{})
+	}()
+	defer func() {
+		cancel()
+		_ = l.Close()
+		<-done
+	}()
+
+	if err := listVia(path); err != nil {
+		t.Fatalf("expected the multiplexer served over the fd, got %v", err)
+	}
+}
+
+func TestListenFromFdRejectsNonListeningFd(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if l, err := listenFromFd(fds[0]); err == nil {
+		_ = l.Close()
+		t.Error("expected an error for a connected socket")
+	}
+
+	f, err := os.Create(filepath.Join(testDir(t), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if l, err := listenFromFd(int(f.Fd())); err == nil {
+		_ = l.Close()
+		t.Error("expected an error for a regular file")
+	}
+}
@@ -6,19 +6,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
-	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/everpeace/ssh-agent-multiplexer/pkg"
 )
@@ -34,16 +38,293 @@ var (
 	targets   []string
 	addTarget string
 	debug     bool
+	quiet     bool
+	logFormat string
+
+	retryMax     int
+	retryBackoff time.Duration
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	upstreamOpTimeout time.Duration
+
+	rejectDuplicateAdd bool
+	clientIdleTimeout  time.Duration
+	includeAuthSock    bool
+	excludedTargets    []string
+	hiddenTargets      []string
+	keepaliveInterval  time.Duration
+	pidFile            string
+	auditLog           string
+	lockScope          string
+	removeAllScope     string
+
+	maxConcurrentConns  int
+	rejectConnsWhenFull bool
+
+	allowRsaSha1Fallback bool
+
+	socketNameTemplate string
+	instance           string
+
+	agentLabels         map[string]string
+	agentPriorities     map[string]int
+	agentMaxConcurrency map[string]int
+
+	broadcastExtensions []string
+	extensionModes      map[string]string
+	allowedKeyTypes     []string
+	requireAllTargets   bool
+	signPreference      string
+	listOrder           string
+	addCommentPrefix    string
+	listenFd            int
+	socketDirMode       string
+	annotateComments    bool
+	hideUnsignableKeys  bool
+	ephemeralAddedKeys  bool
+
+	// targetsBeforeAddTarget are the targets configured before add-target, which the as_configured list order follows
+	targetsBeforeAddTarget []string
 )
 
+// defaultMaxConcurrency is the max concurrent operations to an agent not set by --max-concurrency
+const defaultMaxConcurrency = 1
+
+// agentOptions returns the options for the agent at path on top of the common options.
+func agentOptions(common []pkg.AgentOption, path string) []pkg.AgentOption {
+	maxConcurrency, ok := lookupPath(agentMaxConcurrency, path)
+	if !ok {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	label, _ := lookupPath(agentLabels, path)
+	priority, _ := lookupPath(agentPriorities, path)
+	opts := append([]pkg.AgentOption{}, common...)
+	return append(opts,
+		pkg.WithLabel(label),
+		pkg.WithPriority(priority),
+		pkg.WithMaxConcurrency(maxConcurrency),
+		pkg.WithHidden(isHiddenTarget(path)),
+	)
+}
+
+// lookupPath returns the value of the key in m referring to the same file as p,
+// so that a path written differently in --target and --label still matches.
+func lookupPath[V any](m map[string]V, p string) (V, bool) {
+	if v, ok := m[p]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if samePath(k, p) {
+			return v, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func isHiddenTarget(p string) bool {
+	for _, h := range hiddenTargets {
+		if samePath(p, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// printVersion prints the version to out in the format ("text" or "json").
+func printVersion(out io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := fmt.Fprintf(out, "Version=%s, Revision=%s", Version, Revision)
+		return err
+	case "json":
+		return json.NewEncoder(out).Encode(struct {
+			Version   string `json:"version"`
+			Revision  string `json:"revision"`
+			GoVersion string `json:"go_version"`
+			Platform  string `json:"platform"`
+		}{
+			Version:   Version,
+			Revision:  Revision,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		})
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// logLevel returns the log level for the debug and quiet flags. debug takes precedence.
+func logLevel(debug, quiet bool) zerolog.Level {
+	switch {
+	case debug:
+		return zerolog.DebugLevel
+	case quiet:
+		return zerolog.WarnLevel
+	default:
+		return zerolog.InfoLevel
+	}
+}
+
+// newLogWriter returns the writer for the given log format.
+// "console" returns a human readable writer and "json" returns out as is because zerolog writes JSON by default.
+func newLogWriter(format string, out io.Writer) (io.Writer, error) {
+	switch format {
+	case "console":
+		return zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339, NoColor: true}, nil
+	case "json":
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+}
+
+// parseFlags parses args like pflag.Parse and records targetsBeforeAddTarget,
+// as pflag doesn't keep the order of different flags.
+func parseFlags(fs *pflag.FlagSet, args []string) error {
+	addTargetSeen := false
+	targetsBeforeAddTarget = nil
+	return fs.ParseAll(args, func(flag *pflag.Flag, value string) error {
+		switch flag.Name {
+		case "add-target":
+			addTargetSeen = true
+		case "target":
+			if !addTargetSeen {
+				targetsBeforeAddTarget = append(targetsBeforeAddTarget, strings.Split(value, ",")...)
+			}
+		}
+		return fs.Set(flag.Name, value)
+	})
+}
+
+// addTargetPosition returns the number of targets configured before add-target.
+func addTargetPosition() int {
+	pos := 0
+	for _, t := range targets {
+		for _, b := range targetsBeforeAddTarget {
+			if samePath(t, b) {
+				pos++
+				break
+			}
+		}
+	}
+	return pos
+}
+
+// includeAuthSockTarget adds the agent of SSH_AUTH_SOCK to targets unless it is already configured.
+// It never adds the multiplexer's own socket to avoid a loop.
+func includeAuthSockTarget() {
+	authSock := os.Getenv("SSH_AUTH_SOCK")
+	logger := log.With().Str("SSH_AUTH_SOCK", authSock).Logger()
+	if authSock == "" {
+		logger.Debug().Msg("SSH_AUTH_SOCK is empty. Nothing included")
+		return
+	}
+	if samePath(authSock, listen) {
+		logger.Warn().Msg("SSH_AUTH_SOCK points to the multiplexer itself. Not included")
+		return
+	}
+	for _, t := range append([]string{addTarget}, targets...) {
+		if samePath(authSock, t) {
+			logger.Debug().Msg("SSH_AUTH_SOCK is already configured. Not included")
+			return
+		}
+	}
+	targets = append(targets, authSock)
+	logger.Info().Msg("Included SSH_AUTH_SOCK as a target")
+}
+
+// excludeTargets removes excluded paths from targets. It fails when the add-target is excluded.
+func excludeTargets() error {
+	isExcluded := func(p string) bool {
+		for _, e := range excludedTargets {
+			if samePath(p, e) {
+				return true
+			}
+		}
+		return false
+	}
+	filtered := []string{}
+	for _, t := range targets {
+		if isExcluded(t) {
+			log.Debug().Str("path", t).Msg("Excluded a target")
+			continue
+		}
+		filtered = append(filtered, t)
+	}
+	targets = filtered
+	if addTarget != "" && isExcluded(addTarget) {
+		return fmt.Errorf("add-target %s must not be excluded by exclude-target", addTarget)
+	}
+	return nil
+}
+
+// validateTargets checks that add-target is specified and that no target is add-target or the multiplexer itself.
+func validateTargets() error {
+	if addTarget == "" {
+		return errors.New("add-target must be specified")
+	}
+	for _, t := range targets {
+		if samePath(t, addTarget) {
+			return fmt.Errorf("target paths must not include add-target path: %s", t)
+		}
+	}
+	for _, t := range append([]string{addTarget}, targets...) {
+		if samePath(t, listen) {
+			return fmt.Errorf("target paths must not include the listen path of the multiplexer itself: %s", t)
+		}
+	}
+	return nil
+}
+
 func main() {
 	version := pflag.BoolP("version", "v", false, "Print version and exit")
 	help := pflag.BoolP("help", "h", false, "Print the help")
+	output := pflag.StringP("output", "o", "text", "output format of --version. one of 'text' or 'json'")
 	pflag.BoolVarP(&debug, "debug", "d", false, "debug mode")
-	pflag.StringVarP(&listen, "listen", "l", "", "socket path to listen for the multiplexer. it is generated automatically if not set")
+	pflag.BoolVarP(&quiet, "quiet", "q", false, "log only warnings and errors. debug takes precedence")
+	pflag.StringVar(&logFormat, "log-format", "console", "log format. one of 'console' or 'json'")
+	pflag.StringVarP(&listen, "listen", "l", "", "socket path to listen for the multiplexer. it is generated automatically if not set. on windows, npipe://./pipe/<name> listens on a named pipe")
 	pflag.StringSliceVarP(&targets, "target", "t", nil, "path of target agent to proxy. you can specify this option multiple times")
 	pflag.StringVarP(&addTarget, "add-target", "a", "", "path of target agent for ssh-add command")
-	pflag.Parse()
+	pflag.IntVar(&retryMax, "retry-max", pkg.DefaultRetryMax, "maximum number of tries for each operation to target agents")
+	pflag.DurationVar(&retryBackoff, "retry-backoff", 0, "initial backoff between retries to target agents. it doubles on every retry. 0 means retrying immediately")
+	pflag.BoolVar(&rejectDuplicateAdd, "reject-duplicate-add", false, "reject adding a key which already exists in the add-target agent")
+	pflag.DurationVar(&clientIdleTimeout, "client-idle-timeout", 0, "close client connections idle longer than this. 0 means no timeout")
+	pflag.BoolVar(&includeAuthSock, "include-auth-sock", false, "include the agent of SSH_AUTH_SOCK environment variable as a target")
+	pflag.StringVar(&pidFile, "pid-file", "", "path of the file to write the pid of the multiplexer")
+	pflag.StringVar(&auditLog, "audit-log", "", "path of the file to record all the agent operations as JSON lines")
+	pflag.StringVar(&lockScope, "lock-scope", string(pkg.ScopeAll), "agents which lock/unlock apply to. one of 'all', 'add_targets' or 'targets'")
+	pflag.IntVar(&maxConcurrentConns, "max-concurrent-conns", 0, "maximum number of client connections served concurrently. 0 means no limit")
+	pflag.BoolVar(&rejectConnsWhenFull, "reject-conns-when-full", false, "reject new client connections instead of waiting when max-concurrent-conns is reached")
+	pflag.BoolVar(&allowRsaSha1Fallback, "allow-rsa-sha1-fallback", false, "fall back to ssh-rsa (SHA-1) signatures when a target agent fails to sign an RSA key with rsa-sha2-256/512")
+	pflag.StringVar(&socketNameTemplate, "socket-name-template", defaultSocketNameTemplate, "file name template of the socket generated when listen is not set. {pid}, {user} and {instance} are replaced")
+	pflag.StringVar(&instance, "instance", "", "instance name substituted for {instance} in socket-name-template")
+	pflag.StringToStringVar(&agentLabels, "label", nil, "labels of target agents shown in logs and annotated comments in the form of <path>=<label>. you can specify this option multiple times")
+	pflag.StringSliceVar(&broadcastExtensions, "broadcast-extension", nil, "extension type sent to all the target agents instead of the first one accepting it. you can specify this option multiple times. session-bind@openssh.com is always replayed to the agent signing for the connection and can't be broadcast")
+	pflag.StringVar(&removeAllScope, "remove-all-scope", string(pkg.ScopeAddTargets), "agents which remove-all (ssh-add -D) applies to. one of 'add_targets', 'all' or 'targets'")
+	pflag.StringSliceVar(&allowedKeyTypes, "allowed-key-types", nil, "key types (e.g. ssh-ed25519) listed and used for signing. all the key types are allowed if not set")
+	pflag.BoolVar(&requireAllTargets, "require-all-targets", false, "fail to start if any target agent is unreachable instead of connecting it when it becomes available")
+	pflag.StringSliceVar(&excludedTargets, "exclude-target", nil, "path of agent excluded from targets, e.g. the one included by --include-auth-sock. you can specify this option multiple times")
+	pflag.StringVar(&signPreference, "sign-preference", string(pkg.SignPreferenceTargetsFirst), "which agent signs when multiple agents hold the same key. one of 'targets_first' or 'add_targets_first'")
+	pflag.StringToIntVar(&agentPriorities, "priority", nil, "priorities of target agents in the form of <path>=<priority>. agents with lower priority are tried first. default is 0")
+	pflag.IntVar(&breakerThreshold, "breaker-threshold", 0, "number of consecutive connection failures or timeouts of a target agent to skip it for breaker-cooldown. 0 disables the circuit breaker")
+	pflag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "duration to skip a target agent after breaker-threshold consecutive failures")
+	pflag.DurationVar(&upstreamOpTimeout, "upstream-op-timeout", 0, "timeout of each operation to target agents. 0 means no timeout")
+	pflag.StringVar(&addCommentPrefix, "add-comment-prefix", "", "prefix prepended to the comment of keys added to the add-target")
+	pflag.IntVar(&listenFd, "listen-fd", -1, "file descriptor of a pre-opened listening socket to serve on instead of listen (e.g. for inetd-style activation)")
+	pflag.StringVar(&socketDirMode, "socket-dir-mode", "0700", "permission (in octal) of the parent directory of listen created when it doesn't exist")
+	pflag.BoolVar(&annotateComments, "annotate-comments", false, "append \" [via <label or path>]\" to the comments of listed keys to show which agent holds them")
+	pflag.StringToIntVar(&agentMaxConcurrency, "max-concurrency", nil, fmt.Sprintf("max concurrent operations to target agents in the form of <path>=<n>. 0 means no limit. default is %d, which serializes operations for agents backed by hardware tokens", defaultMaxConcurrency))
+	pflag.StringSliceVar(&hiddenTargets, "hidden-target", nil, "path of target agent whose keys are not listed but can sign for clients knowing the public keys. you can specify this option multiple times")
+	pflag.DurationVar(&keepaliveInterval, "keepalive-interval", 0, "interval of listing keys of target agents to keep their connections alive. 0 disables it")
+	pflag.StringToStringVar(&extensionModes, "extension-mode", nil, "how to aggregate responses to extension types in the form of <extension type>=<mode>. mode is 'first' (default) returning the first success or 'all' requiring all the agents supporting it to succeed with the same response")
+	pflag.BoolVar(&hideUnsignableKeys, "hide-unsignable-keys", false, "hide listed keys which the multiplexer can't use for signing")
+	pflag.BoolVar(&ephemeralAddedKeys, "ephemeral-added-keys", false, "remove keys added by a client from the add-target when the client disconnects")
+	pflag.StringVar(&listOrder, "list-order", string(pkg.ListOrderTargetsFirst), "which agents' keys are listed first among agents with the same priority: 'targets_first', 'add_targets_first' or 'as_configured' following the order of target and add-target on the command line")
+	_ = parseFlags(pflag.CommandLine, os.Args[1:])
 
 	if *help {
 		pflag.Usage()
@@ -51,38 +332,100 @@ func main() {
 	}
 
 	if *version {
-		fmt.Printf("Version=%s, Revision=%s", Version, Revision)
+		if err := printVersion(os.Stdout, *output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
 	// setup logger, signal handlers
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339, NoColor: true})
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	logWriter, err := newLogWriter(logFormat, os.Stderr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid log format")
 	}
+	log.Logger = log.Output(logWriter)
+	zerolog.SetGlobalLevel(logLevel(debug, quiet))
 	log.Info().Str("version", Version).Str("revision", Revision).Msg("")
 
+	// initializing socket to listen
+	var l net.Listener
+	switch {
+	case listenFd >= 0:
+		if listen != "" {
+			log.Fatal().Msg("listen and listen-fd must not be specified together")
+		}
+		l, err = listenFromFd(listenFd)
+		if err != nil {
+			log.Fatal().Err(err).Int("listenFd", listenFd).Msg("Failed to listen on the file descriptor")
+		}
+		listen = l.Addr().String()
+	case listen == "":
+		listen = path.Join(os.TempDir(), renderSocketName(socketNameTemplate, instance))
+	}
+
+	if includeAuthSock {
+		includeAuthSockTarget()
+	}
+	targets = append(targets, hiddenTargets...)
+	if err := excludeTargets(); err != nil {
+		log.Fatal().Err(err).Strs("excludeTargets", excludedTargets).Msg("Invalid exclude-target")
+	}
+
 	// validation
-	if addTarget == "" {
-		log.Fatal().Msg("add-target must be specified")
+	parsedLockScope, err := pkg.ParseScope(lockScope)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid lock-scope")
 	}
-	for _, t := range targets {
-		if t == addTarget {
-			log.Fatal().Msg("target paths must not include add-target path")
+	parsedRemoveAllScope, err := pkg.ParseScope(removeAllScope)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid remove-all-scope")
+	}
+	parsedSignPreference, err := pkg.ParseSignPreference(signPreference)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid sign-preference")
+	}
+	parsedListOrder, err := pkg.ParseListOrder(listOrder)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid list-order")
+	}
+	parsedExtensionModes := map[string]pkg.ExtensionMode{}
+	for extensionType, mode := range extensionModes {
+		parsedExtensionModes[extensionType], err = pkg.ParseExtensionMode(mode)
+		if err != nil {
+			log.Fatal().Err(err).Str("extensionType", extensionType).Msg("Invalid extension-mode")
 		}
+		if extensionType == pkg.SessionBindExtension {
+			log.Warn().Str("extensionType", extensionType).Msg("extension-mode is ignored for session binds, which are always replayed to the agent signing for the connection")
+		}
+	}
+	for _, extensionType := range broadcastExtensions {
+		if extensionType == pkg.SessionBindExtension {
+			log.Warn().Str("extensionType", extensionType).Msg("broadcast-extension is ignored for session binds, which are always replayed to the agent signing for the connection")
+		}
+	}
+	if err := validateTargets(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid targets")
 	}
 
-	// initializing socket to listen
-	if listen == "" {
-		listen = path.Join(os.TempDir(), fmt.Sprintf("ssh-agent-multiplexer-%d.sock", os.Getpid()))
+	parsedSocketDirMode, err := strconv.ParseUint(socketDirMode, 8, 32)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid socket-dir-mode")
 	}
 
 	signalCtx, cancelSignalCtx := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancelSignalCtx()
-	l, err := (&net.ListenConfig{}).Listen(signalCtx, "unix", listen)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to listen")
+	if l == nil {
+		if err := validateSocketPath(listen); err != nil {
+			log.Fatal().Err(err).Msg("Invalid listen path")
+		}
+		if err := ensureSocketDir(listen, os.FileMode(parsedSocketDirMode)); err != nil {
+			log.Fatal().Err(err).Msg("Failed to create the directory of the socket")
+		}
+		l, err = listenSocket(signalCtx, listen)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to listen")
+		}
 	}
 	cleanupCtx, cancelCleanupCtx := context.WithCancel(context.Background())
 	go func() {
@@ -96,33 +439,80 @@ func main() {
 	}()
 
 	// create agents
+	agentOpts := []pkg.AgentOption{
+		pkg.WithRetry(retryMax, retryBackoff),
+		pkg.WithCircuitBreaker(breakerThreshold, breakerCooldown),
+		pkg.WithOpTimeout(upstreamOpTimeout),
+	}
 	targetAgents := []*pkg.Agent{}
 	for _, t := range targets {
-		targetAgents = append(targetAgents, pkg.MustNewAgent(t))
-	}
-	addAgent := pkg.MustNewAgent(addTarget)
-	agt := pkg.NewMuxAgent(targetAgents, addAgent)
-	log.Debug().Msg("Succeed to connect all the target agents.")
-
-	log.Info().Str("listen", listen).Msg("Agent multiplexer listening")
-	for {
-		c, err := l.Accept()
+		a, err := pkg.NewAgent(t, agentOptions(agentOpts, t)...)
 		if err != nil {
-			select {
-			case <-signalCtx.Done():
-				// nop
-			default:
-				log.Error().Err(err).Msg("Failed to listen")
+			if requireAllTargets {
+				log.Fatal().Err(err).Str("path", t).Msg("Failed to connect to the target agent")
 			}
-			break
+			log.Warn().Err(err).Str("path", t).Msg("Failed to connect to the target agent. It will be connected when it becomes available")
 		}
-		go func() {
-			err := agent.ServeAgent(agt, c)
-			if err != nil && err != io.EOF {
-				log.Error().Err(err).Msg("Error in serving agent")
+		targetAgents = append(targetAgents, a)
+	}
+	addAgent := pkg.MustNewAgent(addTarget, agentOptions(agentOpts, addTarget)...)
+	muxOpts := []pkg.MuxAgentOption{
+		pkg.WithRejectDuplicateAdd(rejectDuplicateAdd),
+		pkg.WithLockScope(parsedLockScope),
+		pkg.WithRemoveAllScope(parsedRemoveAllScope),
+		pkg.WithSignPreference(parsedSignPreference),
+		pkg.WithListOrder(parsedListOrder),
+		pkg.WithAddTargetPosition(addTargetPosition()),
+		pkg.WithAllowRsaSha1Fallback(allowRsaSha1Fallback),
+		pkg.WithBroadcastExtensions(broadcastExtensions),
+		pkg.WithExtensionModes(parsedExtensionModes),
+		pkg.WithAllowedKeyTypes(allowedKeyTypes),
+		pkg.WithAddCommentPrefix(addCommentPrefix),
+		pkg.WithAnnotateComments(annotateComments),
+		pkg.WithHideUnsignableKeys(hideUnsignableKeys),
+		pkg.WithEphemeralAddedKeys(ephemeralAddedKeys),
+		pkg.WithVersion(Version, Revision),
+	}
+	if auditLog != "" {
+		auditLogger, err := pkg.NewAuditLogger(auditLog)
+		if err != nil {
+			log.Fatal().Err(err).Str("auditLog", auditLog).Msg("Failed to open the audit log")
+		}
+		defer auditLogger.Close()
+		muxOpts = append(muxOpts, pkg.WithAuditLogger(auditLogger))
+	}
+	agt := pkg.NewMuxAgent(targetAgents, addAgent, muxOpts...)
+	log.Debug().Int("targets", len(targetAgents)).Msg("Succeed to connect the target agents.")
+
+	// the pid file is written after all the fatal startup errors not to leave it behind
+	if pidFile != "" {
+		if err := writePidFile(pidFile); err != nil {
+			log.Fatal().Err(err).Msg("Failed to write the pid file")
+		}
+		defer func() {
+			if err := os.Remove(pidFile); err != nil {
+				log.Warn().Err(err).Str("pidFile", pidFile).Msg("Failed to remove the pid file")
 			}
 		}()
 	}
+
+	go func() {
+		watched := append([]*pkg.Agent{addAgent}, targetAgents...)
+		if err := pkg.WatchAgents(signalCtx, watched); err != nil {
+			log.Warn().Err(err).Msg("Failed to watch target agent sockets. Agents will be reconnected on demand")
+		}
+	}()
+	if keepaliveInterval > 0 {
+		go pkg.KeepAliveAgents(signalCtx, append([]*pkg.Agent{addAgent}, targetAgents...), keepaliveInterval)
+	}
+	go handleStateDumpSignal(signalCtx, agt)
+
+	log.Info().Str("listen", listen).Msg("Agent multiplexer listening")
+	serve(signalCtx, l, agt, serveOptions{
+		maxConcurrentConns:  maxConcurrentConns,
+		rejectConnsWhenFull: rejectConnsWhenFull,
+		clientIdleTimeout:   clientIdleTimeout,
+	})
 	<-cleanupCtx.Done()
 	log.Info().Msg("Agent multiplexer exited")
 }
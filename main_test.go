@@ -0,0 +1,260 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+// setTargetFlags sets the flags of targets until the test ends.
+func setTargetFlags(t *testing.T, ts []string, add, listenPath string, excluded []string) {
+	t.Helper()
+	origTargets, origAdd, origListen, origExcluded := targets, addTarget, listen, excludedTargets
+	targets, addTarget, listen, excludedTargets = ts, add, listenPath, excluded
+	t.Cleanup(func() {
+		targets, addTarget, listen, excludedTargets = origTargets, origAdd, origListen, origExcluded
+	})
+}
+
+func TestIncludeAuthSockTarget(t *testing.T) {
+	dir := testDir(t)
+	a, b, add, mux := filepath.Join(dir, "a.sock"), filepath.Join(dir, "b.sock"), filepath.Join(dir, "add.sock"), filepath.Join(dir, "mux.sock")
+	tests := []struct {
+		name     string
+		authSock string
+		want     []string
+	}{
+		{"included", b, []string{a, b}},
+		{"empty", "", []string{a}},
+		{"already a target", a, []string{a}},
+		{"already a target by relative path", relPath(t, a), []string{a}},
+		{"the add-target", add, []string{a}},
+		{"the multiplexer itself", mux, []string{a}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTargetFlags(t, []string{a}, add, mux, nil)
+			t.Setenv("SSH_AUTH_SOCK", tt.authSock)
+			includeAuthSockTarget()
+			if fmt.Sprint(targets) != fmt.Sprint(tt.want) {
+				t.Errorf("expected targets %v, got %v", tt.want, targets)
+			}
+		})
+	}
+}
+
+func TestExcludeTargets(t *testing.T) {
+	dir := testDir(t)
+	a, b, add, mux := filepath.Join(dir, "a.sock"), filepath.Join(dir, "b.sock"), filepath.Join(dir, "add.sock"), filepath.Join(dir, "mux.sock")
+	tests := []struct {
+		name     string
+		excluded []string
+		want     []string
+		wantErr  bool
+	}{
+		{"nothing excluded", nil, []string{a, b}, false},
+		{"a target excluded", []string{b}, []string{a}, false},
+		{"a target excluded by relative path", []string{relPath(t, a)}, []string{b}, false},
+		{"the add-target excluded", []string{add}, []string{a, b}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTargetFlags(t, []string{a, b}, add, mux, tt.excluded)
+			err := excludeTargets()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if fmt.Sprint(targets) != fmt.Sprint(tt.want) {
+				t.Errorf("expected targets %v, got %v", tt.want, targets)
+			}
+		})
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	dir := testDir(t)
+	a, add, mux := filepath.Join(dir, "a.sock"), filepath.Join(dir, "add.sock"), filepath.Join(dir, "mux.sock")
+	tests := []struct {
+		name    string
+		targets []string
+		add     string
+		wantErr bool
+	}{
+		{"valid", []string{a}, add, false},
+		{"no add-target", []string{a}, "", true},
+		{"add-target in targets", []string{a, add}, add, true},
+		{"target is the multiplexer itself", []string{a, mux}, add, true},
+		{"target is the multiplexer itself by relative path", []string{relPath(t, mux)}, add, true},
+		{"add-target is the multiplexer itself", []string{a}, mux, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTargetFlags(t, tt.targets, tt.add, mux, nil)
+			if err := validateTargets(); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// relPath returns path relative to the working directory.
+func relPath(t *testing.T, path string) string {
+	t.Helper()
+	wd, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
+
+func TestNewLogWriter(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := newLogWriter("json", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := zerolog.New(w)
+		logger.Info().Str("path", "a.sock").Msg("hello")
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("expected a JSON log line, got %q: %v", buf.String(), err)
+		}
+		if line["message"] != "hello" || line["path"] != "a.sock" || line["level"] != "info" {
+			t.Errorf("unexpected log line %v", line)
+		}
+	})
+	t.Run("console", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := newLogWriter("console", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := zerolog.New(w)
+		logger.Info().Str("path", "a.sock").Msg("hello")
+		if out := buf.String(); !strings.Contains(out, "hello") || !strings.Contains(out, "path=a.sock") {
+			t.Errorf("expected a human readable log line, got %q", out)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := newLogWriter("xml", io.Discard); err == nil {
+			t.Fatal("expected an error for the unknown log format")
+		}
+	})
+}
+
+func TestPrintVersionJSON(t *testing.T) {
+	origVersion, origRevision := Version, Revision
+	Version, Revision = "1.2.3", "abcdef"
+	t.Cleanup(func() { Version, Revision = origVersion, origRevision })
+
+	var buf bytes.Buffer
+	if err := printVersion(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", buf.String(), err)
+	}
+	want := map[string]string{
+		"version":    "1.2.3",
+		"revision":   "abcdef",
+		"go_version": runtime.Version(),
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if err := printVersion(io.Discard, "yaml"); err == nil {
+		t.Error("expected an error for the unknown output format")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		debug, quiet bool
+		want         zerolog.Level
+	}{
+		{false, false, zerolog.InfoLevel},
+		{false, true, zerolog.WarnLevel},
+		{true, false, zerolog.DebugLevel},
+		{true, true, zerolog.DebugLevel},
+	}
+	for _, tt := range tests {
+		if got := logLevel(tt.debug, tt.quiet); got != tt.want {
+			t.Errorf("logLevel(debug=%v, quiet=%v) = %v, want %v", tt.debug, tt.quiet, got, tt.want)
+		}
+	}
+}
+
+func TestAddTargetPosition(t *testing.T) {
+	dir := testDir(t)
+	a, b, c, add := filepath.Join(dir, "a.sock"), filepath.Join(dir, "b.sock"), filepath.Join(dir, "c.sock"), filepath.Join(dir, "add.sock")
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"add-target first", []string{"-a", add, "-t", a, "-t", b}, 0},
+		{"add-target in the middle", []string{"-t", a, "--add-target", add, "--target", b}, 1},
+		{"add-target last", []string{"-t", a + "," + b, "-a", add}, 2},
+		{"add-target between comma separated flags", []string{"--target=" + a + "," + b, "-a", add, "-t", c}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTargetFlags(t, nil, "", "", nil)
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			fs.StringSliceVarP(&targets, "target", "t", nil, "")
+			fs.StringVarP(&addTarget, "add-target", "a", "", "")
+			if err := parseFlags(fs, tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := addTargetPosition(); got != tt.want {
+				t.Errorf("expected the add-target at %d among %v, got %d", tt.want, targets, got)
+			}
+		})
+	}
+}
+
+func TestAgentOptionsMatchSamePath(t *testing.T) {
+	path := startUpstream(t, agent.NewKeyring())
+	origLabels, origPriorities := agentLabels, agentPriorities
+	agentLabels, agentPriorities = map[string]string{relPath(t, path): "upstream"}, map[string]int{relPath(t, path): 3}
+	t.Cleanup(func() { agentLabels, agentPriorities = origLabels, origPriorities })
+	logs := captureLogs(t)
+
+	a, err := pkg.NewAgent(path, agentOptions(nil, path)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.NewMuxAgent(nil, a).LogState()
+	for _, line := range logs.lines(t) {
+		if line["message"] == "State of the agent" {
+			if line["label"] != "upstream" || line["priority"] != float64(3) {
+				t.Errorf("expected the label and the priority configured by the relative path, got %v", line)
+			}
+			return
+		}
+	}
+	t.Fatal("expected the state of the agent logged")
+}
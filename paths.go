@@ -0,0 +1,87 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+// npipePrefix is the prefix of listen for a Windows named pipe
+const npipePrefix = "npipe://"
+
+// defaultSocketNameTemplate is the file name of the socket to listen when neither listen nor socket-name-template is set
+const defaultSocketNameTemplate = "ssh-agent-multiplexer-{pid}.sock"
+
+// renderSocketName replaces {pid}, {user} and {instance} in tmpl.
+func renderSocketName(tmpl, instance string) string {
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return strings.NewReplacer(
+		"{pid}", strconv.Itoa(os.Getpid()),
+		"{user}", username,
+		"{instance}", instance,
+	).Replace(tmpl)
+}
+
+// resolvePath returns the absolute path of p with symlinks resolved as far as possible.
+// When p does not exist yet (e.g. the socket to listen), only its parent directory is resolved.
+func resolvePath(p string) string {
+	if pkg.IsAbstractSocket(p) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
+
+// samePath reports whether a and b point to the same file.
+func samePath(a, b string) bool {
+	return resolvePath(a) == resolvePath(b)
+}
+
+// ensureSocketDir creates the parent directory of the socket with mode if it doesn't exist.
+// Existing directories are kept as is.
+func ensureSocketDir(socket string, mode os.FileMode) error {
+	if strings.HasPrefix(socket, npipePrefix) || pkg.IsAbstractSocket(socket) {
+		return nil
+	}
+	dir := filepath.Dir(socket)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	// MkdirAll is subject to umask
+	return os.Chmod(dir, mode)
+}
+
+// validateSocketPath checks the socket path fits in sockaddr_un, which otherwise fails with a cryptic error.
+func validateSocketPath(socket string) error {
+	if strings.HasPrefix(socket, npipePrefix) {
+		return nil
+	}
+	if len(socket) >= maxSocketPathLen {
+		return fmt.Errorf("socket path is too long (%d bytes, must be shorter than %d bytes): %s. please specify a shorter path by --listen", len(socket), maxSocketPathLen, socket)
+	}
+	return nil
+}
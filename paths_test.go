@@ -0,0 +1,108 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSamePath(t *testing.T) {
+	dir := testDir(t)
+	sock := filepath.Join(dir, "mux.sock")
+	if err := os.WriteFile(sock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.sock")
+	if err := os.Symlink(sock, link); err != nil {
+		t.Skipf("symlinks are not available: %v", err)
+	}
+	linkDir := filepath.Join(dir, "linkdir")
+	if err := os.Symlink(dir, linkDir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"same path", sock, sock, true},
+		{"relative path", relPath(t, sock), sock, true},
+		{"unclean path", filepath.Join(dir, ".", "sub", "..", "mux.sock"), sock, true},
+		{"symlink to the socket", link, sock, true},
+		{"socket under symlinked directory", filepath.Join(linkDir, "mux.sock"), sock, true},
+		{"not existing socket under symlinked directory", filepath.Join(linkDir, "new.sock"), filepath.Join(dir, "new.sock"), true},
+		{"different socket", filepath.Join(dir, "other.sock"), sock, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := samePath(tt.a, tt.b); got != tt.want {
+				t.Errorf("samePath(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// socketPathOfLen returns a path of a socket in dir which is n bytes long.
+func socketPathOfLen(t *testing.T, dir string, n int) string {
+	t.Helper()
+	prefix := filepath.Join(dir, "s")
+	if len(prefix) >= n {
+		t.Skipf("temporary directory %s is too long", dir)
+	}
+	return prefix + strings.Repeat("x", n-len(prefix))
+}
+
+func TestValidateSocketPath(t *testing.T) {
+	dir := testDir(t)
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"short path", filepath.Join(dir, "mux.sock"), false},
+		{"longest path", socketPathOfLen(t, dir, maxSocketPathLen-1), false},
+		{"too long path", socketPathOfLen(t, dir, maxSocketPathLen), true},
+		{"named pipe", npipePrefix + strings.Repeat("x", maxSocketPathLen), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSocketPath(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRenderSocketName(t *testing.T) {
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		tmpl, instance, want string
+	}{
+		{defaultSocketNameTemplate, "", "ssh-agent-multiplexer-" + pid + ".sock"},
+		{"mux-{user}.sock", "", "mux-" + username + ".sock"},
+		{"mux-{instance}.sock", "work", "mux-work.sock"},
+		{"mux-{user}-{instance}-{pid}.sock", "work", "mux-" + username + "-work-" + pid + ".sock"},
+		{"mux-{instance}-{instance}.sock", "a", "mux-a-a.sock"},
+		{"mux.sock", "work", "mux.sock"},
+		{"mux-{unknown}.sock", "", "mux-{unknown}.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			if got := renderSocketName(tt.tmpl, tt.instance); got != tt.want {
+				t.Errorf("renderSocketName(%q, %q) = %q, want %q", tt.tmpl, tt.instance, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestEnsureSocketDirMode(t *testing.T) {
+	oldUmask := syscall.Umask(0o027)
+	defer syscall.Umask(oldUmask)
+
+	dir := filepath.Join(testDir(t), "sockets")
+	if err := ensureSocketDir(filepath.Join(dir, "mux.sock"), 0o770); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o770 {
+		t.Errorf("expected the directory created with mode 0770 regardless of umask, got %o", mode)
+	}
+}
+
+func TestEnsureSocketDirKeepsExistingDir(t *testing.T) {
+	dir := testDir(t)
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSocketDir(filepath.Join(dir, "mux.sock"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o755 {
+		t.Errorf("expected the existing directory kept with mode 0755, got %o", mode)
+	}
+}
@@ -0,0 +1,45 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePidFile writes the current pid to path.
+// It refuses when path already references a live process. A stale pid file is overwritten.
+func writePidFile(path string) error {
+	if pid, err := readPidFile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("another process (pid=%d) is running with the pid file %s", pid, path)
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+func readPidFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// signal 0 checks the existence of the process without sending any signal.
+	// EPERM means the process exists but is owned by another user.
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
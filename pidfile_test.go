@@ -0,0 +1,69 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mux.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := readPidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+	// rewriting the pid file of the process itself is allowed
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("expected the pid file of this process to be rewritten, got %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritePidFileOverwritesStalePidFile(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("failed to run a short lived process: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "mux.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("expected the stale pid file to be overwritten, got %v", err)
+	}
+	if pid, _ := readPidFile(path); pid != os.Getpid() {
+		t.Errorf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+}
+
+func TestWritePidFileRefusesLivePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mux.pid")
+	live := os.Getppid()
+	if err := os.WriteFile(path, []byte(strconv.Itoa(live)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePidFile(path); err == nil {
+		t.Fatal("expected an error for the pid file of a live process")
+	}
+	if pid, _ := readPidFile(path); pid != live {
+		t.Errorf("expected the pid file kept, got pid %d", pid)
+	}
+}
@@ -5,8 +5,14 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -14,64 +20,358 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 )
 
-var _ agent.Agent = &Agent{}
+var _ agent.ExtendedAgent = &Agent{}
+
+const (
+	DefaultRetryMax = 3
+	// maxRetryBackoff caps the exponential backoff between retries
+	maxRetryBackoff = 10 * time.Second
+)
+
+// ErrOpTimeout is returned when an operation to the agent doesn't complete within the timeout
+var ErrOpTimeout = errors.New("operation to the agent timed out")
 
 type Agent struct {
-	agent  agent.Agent
+	agent  agent.ExtendedAgent
+	conn   net.Conn
 	path   string
+	label  string
 	logger zerolog.Logger
 
-	lock sync.Mutex // protect updating agent
+	// priority orders agents to try. lower is tried first.
+	priority int
+
+	// hidden agents are excluded from List of MuxAgent but still sign.
+	hidden bool
+
+	retryMax     int
+	retryBackoff time.Duration
+	opTimeout    time.Duration
+	clock        Clock
+
+	// sem limits the number of concurrent operations to the agent. nil means no limit.
+	sem chan struct{}
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// onConnect, if not nil, is called with every new connection before it is used.
+	// The connection is closed when it fails.
+	onConnect func(client agent.ExtendedAgent) error
+
+	// unsignableKeys records the fingerprints of the listed keys which can't be used for signing
+	// so that each of them is warned only once. It is shared with the dedicated agents.
+	unsignableKeys *sync.Map
+
+	lock sync.Mutex // protect agent, conn and the circuit breaker state below
+
+	consecutiveFailures int
+	breakerOpenedAt     time.Time
+}
+
+// AgentOption configures optional parameters of Agent
+type AgentOption func(a *Agent)
+
+// WithRetry sets the maximum number of tries and the initial backoff between tries.
+// The backoff doubles on every retry up to maxRetryBackoff. Zero backoff retries immediately.
+func WithRetry(max int, backoff time.Duration) AgentOption {
+	return func(a *Agent) {
+		if max > 0 {
+			a.retryMax = max
+		}
+		if backoff > 0 {
+			a.retryBackoff = backoff
+		}
+	}
+}
+
+// WithOpTimeout sets the timeout of each operation to the agent. Zero means no timeout.
+func WithOpTimeout(timeout time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.opTimeout = timeout
+	}
+}
+
+// WithClock replaces the clock used for timeouts, backoffs and the circuit breaker.
+func WithClock(clock Clock) AgentOption {
+	return func(a *Agent) {
+		a.clock = clock
+	}
+}
+
+// WithLabel sets a human friendly label of the agent which is included in log lines.
+func WithLabel(label string) AgentOption {
+	return func(a *Agent) {
+		a.label = label
+	}
+}
+
+// WithHidden hides the keys of the agent from List of MuxAgent.
+// The keys can still be used for signing by clients knowing the public keys.
+func WithHidden(hidden bool) AgentOption {
+	return func(a *Agent) {
+		a.hidden = hidden
+	}
+}
+
+// WithPriority sets the priority of the agent. Agents with lower priority are tried first.
+func WithPriority(priority int) AgentOption {
+	return func(a *Agent) {
+		a.priority = priority
+	}
+}
+
+// WithMaxConcurrency limits the number of concurrent operations to the agent,
+// e.g. 1 for agents backed by hardware tokens. Zero means no limit.
+func WithMaxConcurrency(n int) AgentOption {
+	return func(a *Agent) {
+		a.sem = nil
+		if n > 0 {
+			a.sem = make(chan struct{}, n)
+		}
+	}
 }
 
-func MustNewAgent(path string) *Agent {
-	logger := log.With().Str("path", path).Logger()
+// NewAgent creates an Agent connected to the agent listening at path.
+// When it fails to connect, it returns the disconnected Agent with the error.
+// The Agent connects on the next operation or when the socket is created (see WatchAgents).
+func NewAgent(path string, opts ...AgentOption) (*Agent, error) {
 	a := &Agent{
-		path:   path,
-		logger: logger,
+		path:           path,
+		retryMax:       DefaultRetryMax,
+		clock:          RealClock{},
+		unsignableKeys: &sync.Map{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	logCtx := log.With().Str("path", path)
+	if a.label != "" {
+		logCtx = logCtx.Str("label", a.label)
 	}
+	a.logger = logCtx.Logger()
 	if err := a.connect(); err != nil {
-		logger.Fatal().Msg("Failed to connect to the agent")
+		return a, err
+	}
+	return a, nil
+}
+
+// MustNewAgent is like NewAgent but exits the process if it fails to connect to the agent.
+func MustNewAgent(path string, opts ...AgentOption) *Agent {
+	a, err := NewAgent(path, opts...)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("Failed to connect to the agent")
 	}
 	return a
 }
 
+// displayName returns the label of the agent, or the path if the label is empty.
+func (a *Agent) displayName() string {
+	if a.label != "" {
+		return a.label
+	}
+	return a.path
+}
+
+// connect replaces the connection to the agent with a new one.
+// The agent is left disconnected when it fails.
 func (a *Agent) connect() error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
+	return a.connectLocked()
+}
 
+// connectLocked is connect with a.lock held.
+func (a *Agent) connectLocked() error {
+	a.disconnectLocked()
 	conn, err := net.Dial("unix", a.path)
-	a.logger.Debug().Msg("Connected the agent successfully")
 	if err != nil {
 		return err
 	}
-	a.agent = agent.NewClient(conn)
+	client := agent.NewClient(conn)
+	if a.onConnect != nil {
+		if err := a.onConnect(client); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	a.logger.Debug().Msg("Connected the agent successfully")
+	a.conn = conn
+	a.agent = client
 	return nil
 }
 
-func (a *Agent) retry(logger zerolog.Logger, f func() error) error {
-	retryMax := 3
+// dedicated returns a disconnected Agent to the same agent which has its own connection.
+// It shares the options and the concurrency limit with a. onConnect is called with every new connection.
+func (a *Agent) dedicated(onConnect func(client agent.ExtendedAgent) error) *Agent {
+	return &Agent{
+		path:             a.path,
+		label:            a.label,
+		logger:           a.logger,
+		priority:         a.priority,
+		hidden:           a.hidden,
+		retryMax:         a.retryMax,
+		retryBackoff:     a.retryBackoff,
+		opTimeout:        a.opTimeout,
+		clock:            a.clock,
+		sem:              a.sem,
+		breakerThreshold: a.breakerThreshold,
+		breakerCooldown:  a.breakerCooldown,
+		onConnect:        onConnect,
+		unsignableKeys:   a.unsignableKeys,
+	}
+}
+
+// disconnect closes the connection to the agent so that operations blocked on it are released.
+// The agent is connected again on the next operation.
+func (a *Agent) disconnect() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.disconnectLocked()
+}
+
+// disconnectClient disconnects the agent only if client is still its current client.
+// A failing operation must not close a new connection another operation has made in the meantime.
+func (a *Agent) disconnectClient(client agent.ExtendedAgent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if client != nil && a.agent == client {
+		a.disconnectLocked()
+	}
+}
+
+func (a *Agent) disconnectLocked() {
+	if a.conn != nil {
+		_ = a.conn.Close()
+	}
+	a.conn = nil
+	a.agent = nil
+}
+
+// client returns the client of the current connection. It connects the agent if disconnected.
+func (a *Agent) client() (agent.ExtendedAgent, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.agent == nil {
+		if err := a.connectLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return a.agent, nil
+}
+
+// callWithTimeout calls f and gives up waiting for it after the operation timeout.
+// The blocked f must be released by closing the connection with disconnect.
+func (a *Agent) callWithTimeout(f func() error) error {
+	if a.opTimeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1) // buffered not to block f after timeout
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-a.clock.After(a.opTimeout):
+		return ErrOpTimeout
+	}
+}
+
+// retry calls f with reconnecting on connection errors.
+// It fails immediately while the circuit breaker is open.
+func (a *Agent) retry(logger zerolog.Logger, f func(client agent.ExtendedAgent) error) error {
+	if a.sem != nil {
+		a.sem <- struct{}{}
+		defer func() { <-a.sem }()
+	}
+	if !a.breakerAllows() {
+		return ErrBreakerOpen
+	}
+	err := a.retryWithReconnect(logger, f)
+	a.recordBreakerResult(logger, err)
+	return err
+}
+
+func (a *Agent) retryWithReconnect(logger zerolog.Logger, f func(client agent.ExtendedAgent) error) error {
 	var err error
-	for try := 0; try < retryMax; try++ {
-		err = f()
+	backoff := a.retryBackoff
+	for try := 0; try < a.retryMax; try++ {
+		if try > 0 && backoff > 0 {
+			<-a.clock.After(backoff)
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		var client agent.ExtendedAgent
+		client, err = a.client()
+		if err == nil {
+			err = a.callWithTimeout(func() error { return f(client) })
+		}
 		if err != nil {
+			if errors.Is(err, ErrOpTimeout) {
+				logger.Warn().Dur("timeout", a.opTimeout).Msg("Operation timed out. Reconnecting without retry")
+				// close the connection not to leave the operation blocked. it is reconnected on the next operation.
+				a.disconnectClient(client)
+				return err
+			}
+			if !isConnectionError(err) {
+				logger.Debug().Err(err).Int("try", try+1).Msg("Trial failed by non-connection error, not retrying")
+				return err
+			}
 			logger.Debug().Err(err).Int("try", try+1).Msg("Trial failed, retrying with reconnecting...")
-			_ = a.connect()
+			a.disconnectClient(client)
 			continue
 		}
 		return nil
 	}
-	logger.Warn().Err(err).Int("retryMax", retryMax).Msg("Retry max reached")
-	return err
+	logger.Warn().Err(err).Int("attempts", a.retryMax).Msg("Retry max reached. Giving up")
+	return &RetryExhaustedError{Attempts: a.retryMax, Err: err}
+}
+
+// RetryExhaustedError is returned when all the attempts of an operation failed by connection errors.
+type RetryExhaustedError struct {
+	// Attempts is the number of attempts made
+	Attempts int
+	// Err is the error of the last attempt
+	Err error
+}
+
+func (e *RetryExhaustedError) Error() string {
+	return fmt.Sprintf("retry exhausted after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// isConnectionError reports whether err is caused by the connection to the agent so that reconnecting may help.
+// The other errors (e.g. "agent: failure" for a missing key) are semantic ones from the agent.
+func isConnectionError(err error) bool {
+	var retryErr *RetryExhaustedError
+	if errors.As(err, &retryErr) {
+		err = retryErr.Err
+	}
+	var netErr net.Error
+	// agent.NewClient reports I/O errors on the connection as "agent: client error: ..." without wrapping them
+	return strings.HasPrefix(err.Error(), "agent: client error:") ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
 }
 
 // List returns the identities known to the agent.
 func (a *Agent) List() ([]*agent.Key, error) {
 	logger := a.logger.With().Str("method", "List").Logger()
 	var ret []*agent.Key
-	err := a.retry(logger, func() error {
+	err := a.retry(logger, func(client agent.ExtendedAgent) error {
 		var err error
-		ret, err = a.agent.List()
+		ret, err = client.List()
 		if err != nil {
 			return err
 		}
@@ -88,9 +388,45 @@ func (a *Agent) List() ([]*agent.Key, error) {
 func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 	logger := a.logger.With().Str("method", "Sign").Logger()
 	var ret *ssh.Signature
-	err := a.retry(logger, func() error {
+	err := a.retry(logger, func(client agent.ExtendedAgent) error {
+		var err error
+		ret, err = client.Sign(key, data)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SignWithFlags signs like Sign, but allows for additional flags to be sent/received
+func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	logger := a.logger.With().Str("method", "SignWithFlags").Logger()
+	var ret *ssh.Signature
+	err := a.retry(logger, func(client agent.ExtendedAgent) error {
+		var err error
+		ret, err = client.SignWithFlags(key, data, flags)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Extension processes a custom extension request.
+func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	logger := a.logger.With().Str("method", "Extension").Str("extensionType", extensionType).Logger()
+	var ret []byte
+	err := a.retry(logger, func(client agent.ExtendedAgent) error {
 		var err error
-		ret, err = a.agent.Sign(key, data)
+		ret, err = client.Extension(extensionType, contents)
 		if err != nil {
 			return err
 		}
@@ -105,57 +441,93 @@ func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 // Add adds a private key to the agent.
 func (a *Agent) Add(key agent.AddedKey) error {
 	logger := a.logger.With().Str("method", "Add").Logger()
-	return a.retry(logger, func() error {
-		return a.agent.Add(key)
+	return a.retry(logger, func(client agent.ExtendedAgent) error {
+		return client.Add(key)
 	})
 }
 
 // Remove removes all identities with the given public key.
 func (a *Agent) Remove(key ssh.PublicKey) error {
 	logger := a.logger.With().Str("method", "Remove").Logger()
-	return a.retry(logger, func() error {
-		return a.agent.Remove(key)
+	return a.retry(logger, func(client agent.ExtendedAgent) error {
+		return client.Remove(key)
 	})
 }
 
 // RemoveAll removes all identities.
 func (a *Agent) RemoveAll() error {
 	logger := a.logger.With().Str("method", "RemoveAll").Logger()
-	return a.retry(logger, func() error {
-		return a.agent.RemoveAll()
+	return a.retry(logger, func(client agent.ExtendedAgent) error {
+		return client.RemoveAll()
 	})
 }
 
 // Lock locks the agent. Sign and Remove will fail, and List will empty an empty list.
 func (a *Agent) Lock(passphrase []byte) error {
 	logger := a.logger.With().Str("method", "Lock").Logger()
-	return a.retry(logger, func() error {
-		return a.agent.Lock(passphrase)
+	return a.retry(logger, func(client agent.ExtendedAgent) error {
+		return client.Lock(passphrase)
 	})
 }
 
 // Unlock undoes the effect of Lock
 func (a *Agent) Unlock(passphrase []byte) error {
 	logger := a.logger.With().Str("method", "Unlock").Logger()
-	return a.retry(logger, func() error {
-		return a.agent.Unlock(passphrase)
+	return a.retry(logger, func(client agent.ExtendedAgent) error {
+		return client.Unlock(passphrase)
 	})
 }
 
 // Signers returns signers for all the known keys.
+// The signers sign through the agent so that signing retries and reconnects
+// instead of sticking to the connection at the time of listing.
 func (a *Agent) Signers() ([]ssh.Signer, error) {
-	logger := a.logger.With().Str("method", "Sign").Logger()
-	var ret []ssh.Signer
-	err := a.retry(logger, func() error {
-		var err error
-		ret, err = a.agent.Signers()
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+	keys, err := a.List()
 	if err != nil {
 		return nil, err
 	}
+	ret := make([]ssh.Signer, 0, len(keys))
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			// the key is still listed by MuxAgent unless hidden by WithHideUnsignableKeys
+			fp := ssh.FingerprintSHA256(k)
+			if _, warned := a.unsignableKeys.LoadOrStore(fp, true); !warned {
+				a.logger.Warn().Err(err).Str("method", "Signers").Str("fingerprint", fp).Msg("The listed key can't be used for signing. Skipped")
+			}
+			continue
+		}
+		ret = append(ret, &agentSigner{agent: a, pub: pub})
+	}
 	return ret, nil
 }
+
+// agentSigner is ssh.Signer signing with the key in the agent.
+type agentSigner struct {
+	agent *Agent
+	pub   ssh.PublicKey
+}
+
+var _ ssh.AlgorithmSigner = &agentSigner{}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.Sign(s.pub, data)
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case "", s.pub.Type():
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("agent: unsupported algorithm %q", algorithm)
+	}
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
@@ -0,0 +1,285 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestOpTimeoutReleasesBlockedOperation(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	var calls int32
+	fake := newFakeAgent()
+	fake.list = func() ([]*agent.Key, error) {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			<-release
+		}
+		return nil, nil
+	}
+	path := filepath.Join(tempDir(t), "agent.sock")
+	l := serveFakeAgentAt(t, path, fake)
+	a := newTestAgent(t, path, WithOpTimeout(100*time.Millisecond))
+	// make sure the connection is accepted before closing the listener
+	if _, err := a.List(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reconnecting after the timeout fails while the socket is gone
+	_ = l.Close()
+	if _, err := a.List(); !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected ErrOpTimeout, got %v", err)
+	}
+
+	serveFakeAgentAt(t, path, fake)
+	if _, err := a.List(); err != nil {
+		t.Fatalf("expected List to succeed after the agent came back, got %v", err)
+	}
+}
+
+func TestNewAgentConnectsWhenAgentBecomesAvailable(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.sock")
+	a, err := NewAgent(path)
+	if err == nil {
+		t.Fatal("expected an error for the agent not listening yet")
+	}
+	if a == nil {
+		t.Fatal("expected the disconnected agent")
+	}
+
+	fake := newFakeAgent()
+	newTestKey(t, fake, "k1")
+	serveFakeAgentAt(t, path, fake)
+	keys, err := a.List()
+	if err != nil {
+		t.Fatalf("expected List to connect the agent, got %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"client error of connection reset", fmt.Errorf("agent: client error: %v", syscall.ECONNRESET), true},
+		{"client error of broken pipe", fmt.Errorf("agent: client error: %v", &net.OpError{Op: "write", Net: "unix", Err: syscall.EPIPE}), true},
+		{"eof", io.EOF, true},
+		{"closed connection", net.ErrClosed, true},
+		{"net error", &net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}, true},
+		{"retry exhausted", &RetryExhaustedError{Attempts: 3, Err: fmt.Errorf("agent: client error: %v", io.EOF)}, true},
+		{"agent failure", errors.New("agent: failure"), false},
+		{"refused to sign", errors.New("agent: failed to sign challenge"), false},
+		{"extension unsupported", agent.ErrExtensionUnsupported, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isConnectionError(tt.err); got != tt.want {
+				t.Errorf("isConnectionError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryReconnectsOnConnectionReset(t *testing.T) {
+	fake := newFakeAgent()
+	a := newTestAgent(t, startFakeAgent(t, fake))
+
+	tries := 0
+	clients := map[agent.ExtendedAgent]bool{}
+	err := a.retry(a.logger, func(client agent.ExtendedAgent) error {
+		tries++
+		clients[client] = true
+		if tries < 3 {
+			return fmt.Errorf("agent: client error: %v", syscall.ECONNRESET)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success on the third try, got %v", err)
+	}
+	if tries != 3 {
+		t.Errorf("expected 3 tries, got %d", tries)
+	}
+	if len(clients) != 3 {
+		t.Errorf("expected a new connection for each try, got %d connections", len(clients))
+	}
+}
+
+func TestRetryKeepsConnectionMadeByAnotherOperation(t *testing.T) {
+	a := newTestAgent(t, startFakeAgent(t, newFakeAgent()))
+
+	var newer agent.ExtendedAgent
+	clients := []agent.ExtendedAgent{}
+	err := a.retry(a.logger, func(client agent.ExtendedAgent) error {
+		clients = append(clients, client)
+		if len(clients) == 1 {
+			// another operation reconnects while this one is failing on the old connection
+			a.disconnect()
+			var err error
+			if newer, err = a.client(); err != nil {
+				t.Fatal(err)
+			}
+			return fmt.Errorf("agent: client error: %v", syscall.ECONNRESET)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success on the second try, got %v", err)
+	}
+	if len(clients) != 2 || clients[1] != newer {
+		t.Fatal("expected the retry to use the connection made by the other operation instead of closing it")
+	}
+}
+
+func TestRetryReturnsAgentRefusalImmediately(t *testing.T) {
+	fake := newFakeAgent()
+	a := newTestAgent(t, startFakeAgent(t, fake))
+	unknown := newTestKey(t, newFakeAgent(), "not in the agent")
+
+	_, err := a.Sign(unknown, []byte("data"))
+	if err == nil {
+		t.Fatal("expected the agent to refuse signing with an unknown key")
+	}
+	var retryErr *RetryExhaustedError
+	if errors.As(err, &retryErr) {
+		t.Fatalf("expected the refusal without retries, got %v", err)
+	}
+	if n := fake.callCount("Sign"); n != 1 {
+		t.Errorf("expected 1 sign request, got %d", n)
+	}
+}
+
+func TestRetryBacksOffBetweenAttempts(t *testing.T) {
+	clock := newFakeClock()
+	clock.autoAdvance = true
+	a := newTestAgent(t, startFakeAgent(t, newFakeAgent()), WithRetry(5, time.Second), WithClock(clock))
+
+	tries := 0
+	err := a.retry(a.logger, func(client agent.ExtendedAgent) error {
+		tries++
+		if tries <= 2 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success on the third try, got %v", err)
+	}
+	if tries != 3 {
+		t.Errorf("expected 3 tries, got %d", tries)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second}
+	if got := clock.durations(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected backoffs %v, got %v", want, got)
+	}
+}
+
+func TestRetryGivesUpAfterRetryMaxWithCappedBackoff(t *testing.T) {
+	clock := newFakeClock()
+	clock.autoAdvance = true
+	a := newTestAgent(t, startFakeAgent(t, newFakeAgent()), WithRetry(6, 4*time.Second), WithClock(clock))
+
+	tries := 0
+	err := a.retry(a.logger, func(client agent.ExtendedAgent) error {
+		tries++
+		return io.EOF
+	})
+	var retryErr *RetryExhaustedError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 6 {
+		t.Fatalf("expected RetryExhaustedError after 6 attempts, got %v", err)
+	}
+	if unwrapped := errors.Unwrap(err); unwrapped != io.EOF {
+		t.Errorf("expected the error to unwrap to the error of the last attempt, got %v", unwrapped)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected errors.Is to match the error of the last attempt, got %v", err)
+	}
+	if tries != 6 {
+		t.Errorf("expected 6 tries, got %d", tries)
+	}
+	want := []time.Duration{4 * time.Second, 8 * time.Second, maxRetryBackoff, maxRetryBackoff, maxRetryBackoff}
+	if got := clock.durations(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected backoffs %v, got %v", want, got)
+	}
+}
+
+func TestRetryDefaultsToThreeImmediateTries(t *testing.T) {
+	clock := newFakeClock()
+	a := newTestAgent(t, startFakeAgent(t, newFakeAgent()), WithClock(clock))
+
+	tries := 0
+	_ = a.retry(a.logger, func(client agent.ExtendedAgent) error {
+		tries++
+		return io.EOF
+	})
+	if tries != DefaultRetryMax {
+		t.Errorf("expected %d tries, got %d", DefaultRetryMax, tries)
+	}
+	if got := clock.durations(); len(got) != 0 {
+		t.Errorf("expected no backoff, got %v", got)
+	}
+}
+
+func TestMaxConcurrencyLimitsOverlappingOperations(t *testing.T) {
+	for _, tt := range []struct {
+		maxConcurrency int
+		wantOverlap    int32
+	}{
+		{maxConcurrency: 1, wantOverlap: 1},
+		{maxConcurrency: 2, wantOverlap: 2},
+	} {
+		a := newTestAgent(t, startFakeAgent(t, newFakeAgent()), WithMaxConcurrency(tt.maxConcurrency))
+
+		var inFlight, maxInFlight int32
+		release := make(chan struct{})
+		done := make(chan struct{})
+		const ops = 3
+		for i := 0; i < ops; i++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				_ = a.retry(a.logger, func(client agent.ExtendedAgent) error {
+					n := atomic.AddInt32(&inFlight, 1)
+					defer atomic.AddInt32(&inFlight, -1)
+					for {
+						prev := atomic.LoadInt32(&maxInFlight)
+						if n <= prev || atomic.CompareAndSwapInt32(&maxInFlight, prev, n) {
+							break
+						}
+					}
+					<-release
+					return nil
+				})
+			}()
+		}
+
+		// wait for the operations allowed to run concurrently, and a while for the others not to start
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&inFlight) < tt.wantOverlap && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		for i := 0; i < ops; i++ {
+			<-done
+		}
+		if got := atomic.LoadInt32(&maxInFlight); got != tt.wantOverlap {
+			t.Errorf("max-concurrency=%d: expected %d operations overlapping at most, got %d", tt.maxConcurrency, tt.wantOverlap, got)
+		}
+	}
+}
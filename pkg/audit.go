@@ -0,0 +1,99 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditRecord is a record of an agent operation written to the audit log.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	PeerPid     *int      `json:"peer_pid,omitempty"`
+	PeerUid     *int      `json:"peer_uid,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AuditLogger appends AuditRecords to a file as JSON lines.
+// When the file is renamed or removed (e.g. by logrotate), it reopens the path on the next write.
+type AuditLogger struct {
+	path string
+
+	lock sync.Mutex // protect file and fileInfo
+	file *os.File
+	info os.FileInfo
+}
+
+func NewAuditLogger(path string) (*AuditLogger, error) {
+	l := &AuditLogger{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.file = f
+	l.info = info
+	return nil
+}
+
+// reopenIfRotated reopens the path when the opened file is no longer at the path.
+func (l *AuditLogger) reopenIfRotated() error {
+	info, err := os.Stat(l.path)
+	if err == nil && os.SameFile(info, l.info) {
+		return nil
+	}
+	_ = l.file.Close()
+	return l.open()
+}
+
+// Write appends r to the audit log.
+func (l *AuditLogger) Write(r AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.reopenIfRotated(); err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the audit log file.
+func (l *AuditLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+func fingerprint(key ssh.PublicKey) string {
+	if key == nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
@@ -0,0 +1,107 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// readAuditRecords reads all the records in the audit log at path.
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func newTestAuditLogger(t *testing.T, path string) *AuditLogger {
+	t.Helper()
+	l, err := NewAuditLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func TestAuditLogRecordsSign(t *testing.T) {
+	auditPath := filepath.Join(tempDir(t), "audit.log")
+	clock := newFakeClock()
+	target := newFakeAgent()
+	key := newTestKey(t, target, "target")
+	targetPath := startFakeAgent(t, target)
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, targetPath)},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+		WithAuditLogger(newTestAuditLogger(t, auditPath)),
+		WithMuxClock(clock),
+	)
+
+	if _, err := m.Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAuditRecords(t, auditPath)
+	if len(records) != 1 {
+		t.Fatalf("expected a record, got %v", records)
+	}
+	r := records[0]
+	if r.Method != "Sign" || !r.Success || r.Error != "" {
+		t.Errorf("expected a successful Sign record, got %+v", r)
+	}
+	if r.Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Errorf("expected the fingerprint %s, got %s", ssh.FingerprintSHA256(key), r.Fingerprint)
+	}
+	if r.Path != targetPath {
+		t.Errorf("expected the path of the signing agent %s, got %s", targetPath, r.Path)
+	}
+	if !r.Time.Equal(clock.Now()) {
+		t.Errorf("expected the time %v, got %v", clock.Now(), r.Time)
+	}
+}
+
+func TestAuditLoggerReopensRotatedFile(t *testing.T) {
+	path := filepath.Join(tempDir(t), "audit.log")
+	l := newTestAuditLogger(t, path)
+
+	if err := l.Write(AuditRecord{Method: "List"}); err != nil {
+		t.Fatal(err)
+	}
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(AuditRecord{Method: "Sign"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := readAuditRecords(t, rotated); len(records) != 1 || records[0].Method != "List" {
+		t.Errorf("expected the rotated file to keep the record before rotation, got %v", records)
+	}
+	if records := readAuditRecords(t, path); len(records) != 1 || records[0].Method != "Sign" {
+		t.Errorf("expected the reopened file to have the record after rotation, got %v", records)
+	}
+}
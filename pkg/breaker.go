@@ -0,0 +1,71 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrBreakerOpen is returned for operations to an agent skipped by its open circuit breaker
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// WithCircuitBreaker makes the agent skip operations for cooldown after threshold consecutive
+// connection failures or timeouts. After the cooldown, one probe operation is allowed. Zero threshold disables it.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) AgentOption {
+	return func(a *Agent) {
+		a.breakerThreshold = threshold
+		a.breakerCooldown = cooldown
+	}
+}
+
+// breakerAllows reports whether an operation can be sent to the agent.
+func (a *Agent) breakerAllows() bool {
+	if a.breakerThreshold <= 0 {
+		return true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.consecutiveFailures < a.breakerThreshold {
+		return true
+	}
+	if a.clock.Now().Sub(a.breakerOpenedAt) < a.breakerCooldown {
+		return false
+	}
+	// allow a single probe per cooldown
+	a.breakerOpenedAt = a.clock.Now()
+	return true
+}
+
+// recordBreakerResult updates the circuit breaker state. Only connection errors and timeouts count as failures
+// because the other errors mean the agent is alive.
+func (a *Agent) recordBreakerResult(logger zerolog.Logger, err error) {
+	if a.breakerThreshold <= 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err == nil || !(isConnectionError(err) || errors.Is(err, ErrOpTimeout)) {
+		if a.consecutiveFailures >= a.breakerThreshold {
+			logger.Info().Msg("Circuit breaker closed")
+		}
+		a.consecutiveFailures = 0
+		return
+	}
+	a.consecutiveFailures++
+	if a.consecutiveFailures == a.breakerThreshold {
+		a.breakerOpenedAt = a.clock.Now()
+		logger.Warn().Int("consecutiveFailures", a.consecutiveFailures).Dur("cooldown", a.breakerCooldown).Msg("Circuit breaker opened")
+	}
+}
+
+// breakerState returns the number of consecutive connection failures and whether the breaker is open.
+func (a *Agent) breakerState() (int, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.consecutiveFailures, a.breakerThreshold > 0 && a.consecutiveFailures >= a.breakerThreshold
+}
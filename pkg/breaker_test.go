@@ -0,0 +1,94 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestCircuitBreakerOpensAndRecoversAfterCooldown(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(tempDir(t), "agent.sock")
+	a, err := NewAgent(path, WithRetry(1, 0), WithCircuitBreaker(2, time.Minute), WithClock(clock))
+	if err == nil {
+		t.Fatal("expected an error for the agent not listening")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.List(); err == nil || errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("expected a connection error on failure %d, got %v", i+1, err)
+		}
+	}
+	if failures, open := a.breakerState(); !open || failures != 2 {
+		t.Fatalf("expected the breaker open after 2 failures, got failures=%d open=%v", failures, open)
+	}
+
+	fake := newFakeAgent()
+	serveFakeAgentAt(t, path, fake)
+	if _, err := a.List(); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expected ErrBreakerOpen during the cooldown, got %v", err)
+	}
+	if n := fake.callCount("List"); n != 0 {
+		t.Fatalf("expected no request to the agent during the cooldown, got %d", n)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := a.List(); err != nil {
+		t.Fatalf("expected the probe after the cooldown to succeed, got %v", err)
+	}
+	if failures, open := a.breakerState(); open || failures != 0 {
+		t.Fatalf("expected the breaker closed after the probe, got failures=%d open=%v", failures, open)
+	}
+}
+
+func TestMuxAgentSkipsAgentWithOpenBreaker(t *testing.T) {
+	clock := newFakeClock()
+	down, _ := NewAgent(filepath.Join(tempDir(t), "down.sock"), WithRetry(1, 0), WithCircuitBreaker(1, time.Minute), WithClock(clock))
+	if _, err := down.List(); err == nil {
+		t.Fatal("expected the agent not listening to fail")
+	}
+	up := newFakeAgent()
+	newTestKey(t, up, "up")
+	m := NewMuxAgent([]*Agent{down, newTestAgent(t, startFakeAgent(t, up))}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatalf("expected List to skip the agent with the open breaker, got %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "up" {
+		t.Fatalf("expected the key of the agent up, got %v", keys)
+	}
+	if failures, _ := down.breakerState(); failures != 1 {
+		t.Errorf("expected the open breaker not to try the agent again, got %d failures", failures)
+	}
+}
+
+func TestCircuitBreakerOpensOnTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	fake := newFakeAgent()
+	fake.list = func() ([]*agent.Key, error) {
+		<-release
+		return nil, nil
+	}
+	a := newTestAgent(t, startFakeAgent(t, fake), WithOpTimeout(10*time.Millisecond), WithCircuitBreaker(2, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.List(); !errors.Is(err, ErrOpTimeout) {
+			t.Fatalf("expected ErrOpTimeout on try %d, got %v", i+1, err)
+		}
+	}
+	if failures, open := a.breakerState(); !open || failures != 2 {
+		t.Fatalf("expected the breaker open after 2 timeouts, got failures=%d open=%v", failures, open)
+	}
+	if _, err := a.List(); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expected ErrBreakerOpen for the hung agent, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestOpTimeoutExpiresWithFakeClock(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	fake := newFakeAgent()
+	fake.list = func() ([]*agent.Key, error) {
+		<-release
+		return nil, nil
+	}
+	clock := newFakeClock()
+	a := newTestAgent(t, startFakeAgent(t, fake), WithOpTimeout(time.Minute), WithClock(clock))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.List()
+		done <- err
+	}()
+	clock.waitForWaiters(t, 1)
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("expected List to wait until the timeout, got %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := <-done; !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected ErrOpTimeout, got %v", err)
+	}
+}
+
+func TestStatusUptimeWithFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	addTarget := newTestAgent(t, startFakeAgent(t, newFakeAgent()))
+	m := NewMuxAgent(nil, addTarget, WithMuxClock(clock))
+	clock.Advance(90 * time.Second)
+
+	res, err := m.Extension(StatusExtension, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload struct{ Status string }
+	if err := ssh.Unmarshal(res[1:], &payload); err != nil {
+		t.Fatal(err)
+	}
+	var status Status
+	if err := json.Unmarshal([]byte(payload.Status), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.UptimeSeconds != 90 {
+		t.Errorf("expected uptime 90 seconds, got %d", status.UptimeSeconds)
+	}
+	if !status.StartedAt.Equal(clock.Now().Add(-90 * time.Second)) {
+		t.Errorf("expected started at the time of the fake clock, got %v", status.StartedAt)
+	}
+}
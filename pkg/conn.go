@@ -0,0 +1,33 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"net"
+	"time"
+)
+
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// WithIdleTimeout wraps c so that reading from it fails when no data arrives within timeout.
+// The deadline is extended on every Read. Thus, time spent for serving a request
+// (e.g. a Sign waiting for a hardware token) is not counted as idle.
+// It returns c as is when timeout is not positive.
+func WithIdleTimeout(c net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return c
+	}
+	return &idleTimeoutConn{Conn: c, timeout: timeout}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
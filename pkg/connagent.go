@@ -0,0 +1,228 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var _ agent.ExtendedAgent = &ConnAgent{}
+
+// ConnAgent is an agent serving a single client connection.
+// It holds the state scoped to the connection and delegates the shared operations to MuxAgent.
+type ConnAgent struct {
+	*MuxAgent
+
+	// peer is the process on the other side of the connection
+	peer *peer
+
+	stateLock sync.Mutex // protect the connection scoped state below
+
+	// session-bind@openssh.com requests of the connection, which are replayed to the agent
+	// which actually signs, instead of binding only the first agent accepting the extension.
+	// The binds are replayed on a connection to the agent dedicated to this connection
+	// because the agent refuses to bind a connection shared by other clients.
+	sessionBinds [][]byte
+	boundAgents  map[*Agent]*Agent
+
+	// addedKeys are the keys added on the connection, which are removed on Close
+	// when the added keys are ephemeral.
+	addedKeys []ssh.PublicKey
+}
+
+// peer describes the process on the other side of a client connection
+type peer struct {
+	// connID identifies the connection in logs
+	connID string
+
+	// credKnown is false when the credentials below couldn't be obtained
+	credKnown bool
+	pid       int
+	uid       int
+}
+
+// logger returns l annotated with the connection ID of the peer, if any.
+func (p *peer) logger(l zerolog.Logger) *zerolog.Logger {
+	if p != nil && p.connID != "" {
+		l = l.With().Str("connID", p.connID).Logger()
+	}
+	return &l
+}
+
+// ForConnection returns a ConnAgent serving a single client connection.
+// connID is attached to all the logs of the operations on the connection.
+func (m *MuxAgent) ForConnection(conn net.Conn, connID string) *ConnAgent {
+	c := &ConnAgent{
+		MuxAgent:    m,
+		peer:        &peer{connID: connID},
+		boundAgents: map[*Agent]*Agent{},
+	}
+	pid, uid, err := PeerCred(conn)
+	if err != nil {
+		c.peer.logger(log.Logger).Debug().Err(err).Msg("Failed to get peer credentials of the connection")
+	} else {
+		c.peer.credKnown, c.peer.pid, c.peer.uid = true, pid, uid
+	}
+	return c
+}
+
+// List implements agent.Agent
+func (c *ConnAgent) List() ([]*agent.Key, error) {
+	return c.list(c.peer)
+}
+
+// Lock implements agent.Agent
+func (c *ConnAgent) Lock(passphrase []byte) error {
+	return c.lock(c.peer, passphrase)
+}
+
+// Unlock implements agent.Agent
+func (c *ConnAgent) Unlock(passphrase []byte) error {
+	return c.unlock(c.peer, passphrase)
+}
+
+// Add implements agent.Agent
+func (c *ConnAgent) Add(key agent.AddedKey) error {
+	if err := c.add(c.peer, key); err != nil {
+		return err
+	}
+	if c.ephemeralAddedKeys {
+		pk, err := addedKeyPublicKey(key)
+		if err != nil {
+			return err
+		}
+		c.stateLock.Lock()
+		c.addedKeys = append(c.addedKeys, pk)
+		c.stateLock.Unlock()
+	}
+	return nil
+}
+
+// Close removes the keys added on the connection from the add-target when they are ephemeral,
+// and closes the connections to the agents bound to the session.
+// It must be called after the connection is closed.
+func (c *ConnAgent) Close() error {
+	for _, bound := range c.takeBoundAgents() {
+		bound.disconnect()
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	errs := []string{}
+	for _, key := range c.addedKeys {
+		err := c.AddTarget.Remove(key)
+		c.audit(c.peer, "Remove", key, c.AddTarget.path, err)
+		logger := c.peer.logger(c.AddTarget.logger).With().Str("method", "Remove").Str("fingerprint", fingerprint(key)).Logger()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to remove an ephemeral key")
+			errs = append(errs, err.Error())
+			continue
+		}
+		logger.Debug().Msg("Removed an ephemeral key on disconnect")
+	}
+	c.addedKeys = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove ephemeral keys: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Remove implements agent.Agent
+func (c *ConnAgent) Remove(key ssh.PublicKey) error {
+	return c.remove(c.peer, key)
+}
+
+// RemoveAll implements agent.Agent
+func (c *ConnAgent) RemoveAll() error {
+	return c.removeAll(c.peer)
+}
+
+// Sign implements agent.Agent
+func (c *ConnAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags implements agent.ExtendedAgent
+func (c *ConnAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return c.signWithFlags(c.peer, key, data, flags, c.boundAgent)
+}
+
+// Extension implements agent.ExtendedAgent
+func (c *ConnAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != SessionBindExtension {
+		return c.extension(c.peer, extensionType, contents)
+	}
+	c.stateLock.Lock()
+	c.sessionBinds = append(c.sessionBinds, contents)
+	c.stateLock.Unlock()
+	// the bound connections reconnect to replay all the binds recorded so far
+	for _, bound := range c.takeBoundAgents() {
+		bound.disconnect()
+	}
+	c.peer.logger(log.Logger).Debug().Str("method", "Extension").Str("extensionType", extensionType).Msg("Recorded a session bind")
+	return nil, nil
+}
+
+// boundAgent returns the agent to sign with in place of a.
+// It is a itself when the connection has no session binds.
+func (c *ConnAgent) boundAgent(a *Agent) *Agent {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if len(c.sessionBinds) == 0 {
+		return a
+	}
+	bound, ok := c.boundAgents[a]
+	if !ok {
+		bound = a.dedicated(func(client agent.ExtendedAgent) error {
+			return c.replaySessionBinds(a, client)
+		})
+		c.boundAgents[a] = bound
+	}
+	return bound
+}
+
+// takeBoundAgents forgets the bound agents and returns them to be closed.
+func (c *ConnAgent) takeBoundAgents() []*Agent {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	bound := make([]*Agent, 0, len(c.boundAgents))
+	for _, b := range c.boundAgents {
+		bound = append(bound, b)
+	}
+	c.boundAgents = map[*Agent]*Agent{}
+	return bound
+}
+
+// replaySessionBinds sends all the session binds of the connection over a new connection to a.
+// Agents not supporting session binds (e.g. gpg-agent or ssh-agent before OpenSSH 8.9) sign unbound.
+func (c *ConnAgent) replaySessionBinds(a *Agent, client agent.ExtendedAgent) error {
+	c.stateLock.Lock()
+	binds := c.sessionBinds
+	c.stateLock.Unlock()
+	logger := c.peer.logger(a.logger).With().Str("method", "Extension").Str("extensionType", SessionBindExtension).Logger()
+	for _, contents := range binds {
+		if _, err := client.Extension(SessionBindExtension, contents); err != nil {
+			if isConnectionError(err) {
+				return err
+			}
+			if errors.Is(err, agent.ErrExtensionUnsupported) {
+				logger.Debug().Msg("The agent doesn't support session binds. Signing unbound")
+				return nil
+			}
+			logger.Warn().Err(err).Msg("The agent refused a session bind")
+			return fmt.Errorf("%w by %s: %v", ErrSessionBindRefused, a.displayName(), err)
+		}
+	}
+	logger.Debug().Int("binds", len(binds)).Msg("Replayed session binds")
+	return nil
+}
@@ -0,0 +1,239 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sessionBind is the contents of session-bind@openssh.com
+type sessionBind struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+// bindingAgent serves a keyring like OpenSSH's ssh-agent which binds session IDs to each connection
+// and rejects binding a connection already bound for authentication.
+type bindingAgent struct {
+	keyring agent.ExtendedAgent
+
+	mu sync.Mutex
+	// signedSessions records the session IDs bound to the connection of each Sign
+	signedSessions [][]string
+}
+
+// boundConnAgent is the agent serving a single connection of bindingAgent
+type boundConnAgent struct {
+	agent.ExtendedAgent
+	parent   *bindingAgent
+	sessions []string
+	forAuth  bool
+}
+
+func (b *boundConnAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != SessionBindExtension {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	var bind sessionBind
+	if err := ssh.Unmarshal(contents, &bind); err != nil {
+		return nil, err
+	}
+	if b.forAuth {
+		// "attempt to bind session ID to socket previously bound for authentication attempt"
+		return nil, errors.New("already bound for authentication")
+	}
+	b.sessions = append(b.sessions, string(bind.SessionID))
+	b.forAuth = !bind.Forwarding
+	return nil, nil
+}
+
+func (b *boundConnAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return b.SignWithFlags(key, data, 0)
+}
+
+func (b *boundConnAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	b.parent.mu.Lock()
+	b.parent.signedSessions = append(b.parent.signedSessions, append([]string{}, b.sessions...))
+	b.parent.mu.Unlock()
+	return b.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (b *bindingAgent) signed() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string{}, b.signedSessions...)
+}
+
+// startBindingAgent serves a new bindingAgent and returns it with the path of its socket.
+func startBindingAgent(t *testing.T) (*bindingAgent, string) {
+	t.Helper()
+	b := &bindingAgent{keyring: agent.NewKeyring().(agent.ExtendedAgent)}
+	path := filepath.Join(tempDir(t), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(&boundConnAgent{ExtendedAgent: b.keyring, parent: b}, c)
+			}()
+		}
+	}()
+	return b, path
+}
+
+func newTestConnAgent(t *testing.T, m *MuxAgent, connID string) *ConnAgent {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	c := m.ForConnection(server, connID)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func bindSession(t *testing.T, c *ConnAgent, sessionID string, forwarding bool) {
+	t.Helper()
+	contents := ssh.Marshal(sessionBind{SessionID: []byte(sessionID), Forwarding: forwarding})
+	if _, err := c.Extension(SessionBindExtension, contents); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnAgentBindsSessionsOnDedicatedConnections(t *testing.T) {
+	upstream, path := startBindingAgent(t)
+	key := newTestKey(t, upstream.keyring, "target")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, path)}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	first := newTestConnAgent(t, m, "first")
+	second := newTestConnAgent(t, m, "second")
+	bindSession(t, first, "session-1", false)
+	bindSession(t, second, "session-2", false)
+
+	for _, c := range []*ConnAgent{first, second, first} {
+		if _, err := c.Sign(key, []byte("data")); err != nil {
+			t.Fatalf("expected signing on %s to succeed, got %v", c.peer.connID, err)
+		}
+	}
+	want := [][]string{{"session-1"}, {"session-2"}, {"session-1"}}
+	got := upstream.signed()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d signs, got %v", len(want), got)
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) || got[i][0] != want[i][0] {
+			t.Errorf("sign %d: expected the connection bound to %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestConnAgentReplaysAllBindsOnReconnect(t *testing.T) {
+	upstream, path := startBindingAgent(t)
+	key := newTestKey(t, upstream.keyring, "target")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, path)}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	c := newTestConnAgent(t, m, "conn")
+	bindSession(t, c, "hop-1", true)
+	if _, err := c.Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	bindSession(t, c, "hop-2", false)
+	if _, err := c.Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	got := upstream.signed()
+	if len(got) != 2 || len(got[1]) != 2 || got[1][0] != "hop-1" || got[1][1] != "hop-2" {
+		t.Fatalf("expected the last sign bound to [hop-1 hop-2], got %v", got)
+	}
+}
+
+func TestConnAgentFailsSignWhenSessionBindRefused(t *testing.T) {
+	upstream, path := startBindingAgent(t)
+	key := newTestKey(t, upstream.keyring, "target")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, path)}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	c := newTestConnAgent(t, m, "conn")
+	bindSession(t, c, "session-1", false)
+	bindSession(t, c, "session-2", false)
+	_, err := c.Sign(key, []byte("data"))
+	if !errors.Is(err, ErrSessionBindRefused) {
+		t.Fatalf("expected ErrSessionBindRefused, got %v", err)
+	}
+	if got := upstream.signed(); len(got) != 0 {
+		t.Fatalf("expected no sign on the refused connection, got %v", got)
+	}
+}
+
+func TestConnAgentSignsUnboundWithAgentNotSupportingSessionBind(t *testing.T) {
+	target := newFakeAgent()
+	key := newTestKey(t, target, "target")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	c := newTestConnAgent(t, m, "conn")
+	bindSession(t, c, "session-1", false)
+	if _, err := c.Sign(key, []byte("data")); err != nil {
+		t.Fatalf("expected signing with the agent not supporting session binds to succeed, got %v", err)
+	}
+	if n := target.callCount("Extension"); n != 1 {
+		t.Errorf("expected the bind to be tried once, got %d", n)
+	}
+}
+
+func TestConnAgentRemovesEphemeralKeysOnClose(t *testing.T) {
+	for _, ephemeral := range []bool{true, false} {
+		addTarget := newFakeAgent()
+		newTestKey(t, addTarget, "existing")
+		m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, addTarget)), WithEphemeralAddedKeys(ephemeral))
+		c := newTestConnAgent(t, m, "conn")
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Add(agent.AddedKey{PrivateKey: priv, Comment: "added"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := addTarget.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments := []string{}
+		for _, k := range keys {
+			comments = append(comments, k.Comment)
+		}
+		want := "existing,added"
+		if ephemeral {
+			want = "existing"
+		}
+		if strings.Join(comments, ",") != want {
+			t.Errorf("ephemeral=%v: expected the keys %s left in the add-target, got %v", ephemeral, want, comments)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fakeAgent is an upstream agent backed by a keyring whose methods can be overridden by the hooks.
+type fakeAgent struct {
+	agent.ExtendedAgent
+
+	list          func() ([]*agent.Key, error)
+	add           func(key agent.AddedKey) error
+	signWithFlags func(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error)
+	remove        func(key ssh.PublicKey) error
+	removeAll     func() error
+	extension     func(extensionType string, contents []byte) ([]byte, error)
+	lock          func(passphrase []byte) error
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		calls:         map[string]int{},
+	}
+}
+
+func (f *fakeAgent) called(method string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[method]++
+}
+
+func (f *fakeAgent) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeAgent) List() ([]*agent.Key, error) {
+	f.called("List")
+	if f.list != nil {
+		return f.list()
+	}
+	return f.ExtendedAgent.List()
+}
+
+func (f *fakeAgent) Add(key agent.AddedKey) error {
+	f.called("Add")
+	if f.add != nil {
+		return f.add(key)
+	}
+	return f.ExtendedAgent.Add(key)
+}
+
+func (f *fakeAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	f.called("Sign")
+	return f.ExtendedAgent.Sign(key, data)
+}
+
+func (f *fakeAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	f.called("Sign")
+	if f.signWithFlags != nil {
+		return f.signWithFlags(key, data, flags)
+	}
+	return f.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (f *fakeAgent) Remove(key ssh.PublicKey) error {
+	f.called("Remove")
+	if f.remove != nil {
+		return f.remove(key)
+	}
+	return f.ExtendedAgent.Remove(key)
+}
+
+func (f *fakeAgent) RemoveAll() error {
+	f.called("RemoveAll")
+	if f.removeAll != nil {
+		return f.removeAll()
+	}
+	return f.ExtendedAgent.RemoveAll()
+}
+
+func (f *fakeAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	f.called("Extension")
+	if f.extension != nil {
+		return f.extension(extensionType, contents)
+	}
+	return f.ExtendedAgent.Extension(extensionType, contents)
+}
+
+func (f *fakeAgent) Lock(passphrase []byte) error {
+	f.called("Lock")
+	if f.lock != nil {
+		return f.lock(passphrase)
+	}
+	return f.ExtendedAgent.Lock(passphrase)
+}
+
+func (f *fakeAgent) Unlock(passphrase []byte) error {
+	f.called("Unlock")
+	return f.ExtendedAgent.Unlock(passphrase)
+}
+
+// tempDir returns a short temporary directory so that socket paths fit in sockaddr_un.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// serveFakeAgentAt serves a on a unix socket at path until the returned listener is closed.
+func serveFakeAgentAt(t *testing.T, path string, a agent.Agent) net.Listener {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(a, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// startDroppableFakeAgent serves a on a new unix socket and returns its path with the accepted connections
+// so that the test can drop them.
+func startDroppableFakeAgent(t *testing.T, a agent.Agent) (string, <-chan net.Conn) {
+	t.Helper()
+	path := filepath.Join(tempDir(t), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(a, c)
+			}()
+		}
+	}()
+	return path, accepted
+}
+
+// startFakeAgent serves a on a new unix socket and returns its path.
+func startFakeAgent(t *testing.T, a agent.Agent) string {
+	t.Helper()
+	path := filepath.Join(tempDir(t), "agent.sock")
+	serveFakeAgentAt(t, path, a)
+	return path
+}
+
+func newTestAgent(t *testing.T, path string, opts ...AgentOption) *Agent {
+	t.Helper()
+	a, err := NewAgent(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// newTestPrivateKey returns a new ed25519 key not added to any agent and its public key.
+func newTestPrivateKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, sshPub
+}
+
+// newTestKey adds a new ed25519 key to a and returns its public key.
+func newTestKey(t *testing.T, a agent.Agent, comment string) ssh.PublicKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub
+}
+
+// newTestRSAKey adds a new RSA key to a and returns its public key.
+func newTestRSAKey(t *testing.T, a agent.Agent, comment string) ssh.PublicKey {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub
+}
+
+// logBuffer collects the log lines written while testing. It is safe for concurrent writes.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// messages returns the JSON log lines with the message.
+func (b *logBuffer) messages(t *testing.T, message string) []map[string]interface{} {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := []map[string]interface{}{}
+	for _, l := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("invalid log line %q: %v", l, err)
+		}
+		if line["message"] == message {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// captureLogs writes the logs of the loggers created after it to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	return buf
+}
+
+// fakeClock is Clock whose time only moves by Advance.
+// With autoAdvance, After fires immediately advancing the time by the duration.
+type fakeClock struct {
+	mu          sync.Mutex
+	now         time.Time
+	autoAdvance bool
+	waiters     []fakeWaiter
+	// afters records the durations requested by After
+	afters []time.Duration
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+var _ Clock = &fakeClock{}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.afters = append(c.afters, d)
+	ch := make(chan time.Time, 1)
+	if c.autoAdvance {
+		c.now = c.now.Add(d)
+	}
+	if d <= 0 || c.autoAdvance {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the time by d and fires the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitForWaiters blocks until n timers are waiting to fire.
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d timers waiting, got %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeClock) durations() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration{}, c.afters...)
+}
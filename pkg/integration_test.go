@@ -0,0 +1,155 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build integration
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgent is a real ssh-agent process listening at path
+type sshAgent struct {
+	path string
+	cmd  *exec.Cmd
+}
+
+// startSSHAgent starts ssh-agent listening at path. It skips the test when ssh-agent is not installed.
+// The agent is stopped on cleanup.
+func startSSHAgent(t *testing.T, path string) *sshAgent {
+	t.Helper()
+	bin, err := exec.LookPath("ssh-agent")
+	if err != nil {
+		t.Skip("ssh-agent is not installed")
+	}
+	cmd := exec.Command(bin, "-D", "-a", path)
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK=")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &sshAgent{path: path, cmd: cmd}
+	t.Cleanup(s.stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ssh-agent didn't start listening at %s: %v", path, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stop kills the ssh-agent and removes its socket.
+func (s *sshAgent) stop() {
+	if s.cmd.Process == nil || s.cmd.ProcessState != nil {
+		return
+	}
+	_ = s.cmd.Process.Kill()
+	_ = s.cmd.Wait()
+	_ = os.Remove(s.path)
+}
+
+// newIntegrationAgent creates an Agent connected to the ssh-agent.
+func newIntegrationAgent(t *testing.T, s *sshAgent) *Agent {
+	t.Helper()
+	a, err := NewAgent(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// integrationDir returns a short temporary directory so that socket paths fit in sockaddr_un.
+func integrationDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func newIntegrationKey(t *testing.T) (ssh.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub, priv
+}
+
+func TestIntegrationAddListSign(t *testing.T) {
+	dir := integrationDir(t)
+	target := startSSHAgent(t, filepath.Join(dir, "target.sock"))
+	addTarget := startSSHAgent(t, filepath.Join(dir, "add.sock"))
+	m := NewMuxAgent([]*Agent{newIntegrationAgent(t, target)}, newIntegrationAgent(t, addTarget))
+
+	pub, priv := newIntegrationKey(t)
+	if err := m.Add(agent.AddedKey{PrivateKey: priv, Comment: "integration"}); err != nil {
+		t.Fatalf("failed to add a key via the mux: %v", err)
+	}
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "integration" || !keysEqual(keys[0], pub) {
+		t.Fatalf("expected the added key, got %v", keys)
+	}
+
+	data := []byte("integration test data")
+	sig, err := m.Sign(pub, data)
+	if err != nil {
+		t.Fatalf("failed to sign via the mux: %v", err)
+	}
+	if err := pub.Verify(data, sig); err != nil {
+		t.Fatalf("failed to verify the signature: %v", err)
+	}
+}
+
+func TestIntegrationReconnectsRestartedAgent(t *testing.T) {
+	path := filepath.Join(integrationDir(t), "add.sock")
+	first := startSSHAgent(t, path)
+	m := NewMuxAgent(nil, newIntegrationAgent(t, first))
+	if _, err := m.List(); err != nil {
+		t.Fatal(err)
+	}
+
+	first.stop()
+	startSSHAgent(t, path)
+
+	pub, priv := newIntegrationKey(t)
+	if err := m.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatalf("expected Add to reconnect to the restarted agent, got %v", err)
+	}
+	data := []byte("integration test data")
+	sig, err := m.Sign(pub, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify(data, sig); err != nil {
+		t.Fatalf("failed to verify the signature: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeepAliveAgents lists the keys of each agent every interval to keep the connections warm
+// and to reconnect dead ones before clients need them. It blocks until ctx is done.
+func KeepAliveAgents(ctx context.Context, agents []*Agent, interval time.Duration) {
+	var wg sync.WaitGroup
+	for _, a := range agents {
+		wg.Add(1)
+		go func(a *Agent) {
+			defer wg.Done()
+			a.keepAlive(ctx, interval)
+		}(a)
+	}
+	wg.Wait()
+}
+
+func (a *Agent) keepAlive(ctx context.Context, interval time.Duration) {
+	logger := a.logger.With().Str("method", "KeepAlive").Logger()
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.clock.After(interval):
+		}
+		_, err := a.List()
+		switch {
+		case err != nil && healthy:
+			logger.Warn().Err(err).Msg("Keepalive failed")
+		case err == nil && !healthy:
+			logger.Info().Msg("Keepalive recovered")
+		}
+		healthy = err == nil
+	}
+}
@@ -0,0 +1,38 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveReconnectsDroppedAgent(t *testing.T) {
+	path, accepted := startDroppableFakeAgent(t, newFakeAgent())
+	clock := newFakeClock()
+	a := newTestAgent(t, path, WithClock(clock))
+	// the upstream drops the connection while idle
+	_ = (<-accepted).Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		KeepAliveAgents(ctx, []*Agent{a}, time.Minute)
+	}()
+	clock.waitForWaiters(t, 1)
+	clock.Advance(time.Minute)
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the keepalive to reconnect the dropped agent")
+	}
+}
@@ -6,42 +6,453 @@ package pkg
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-var _ agent.Agent = &MuxAgent{}
+var _ agent.ExtendedAgent = &MuxAgent{}
+
+const (
+	// VersionExtension is the extension type answered by MuxAgent itself with its version
+	VersionExtension = "version@ssh-agent-multiplexer"
+
+	// SessionBindExtension binds a client connection to an ssh session.
+	// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent
+	SessionBindExtension = "session-bind@openssh.com"
+
+	// RemoveByFingerprintExtension removes the key of the SHA256 fingerprint from the agent holding it
+	RemoveByFingerprintExtension = "remove-by-fingerprint@ssh-agent-multiplexer"
+
+	// RestrictDestinationConstraint is the key constraint extension restricting the destinations of the key.
+	// Agents not supporting it refuse to add the key.
+	RestrictDestinationConstraint = "restrict-destination-v00@openssh.com"
+
+	// StatusExtension is the extension type answered by MuxAgent itself with its Status in JSON
+	StatusExtension = "status@ssh-agent-multiplexer"
+
+	// agentSuccess is SSH_AGENT_SUCCESS message type in [PROTOCOL.agent].
+	// extension responses must start with the message type.
+	agentSuccess = 6
+)
 
 type MuxAgent struct {
 	AddTarget *Agent
 	Targets   []*Agent
+
+	rejectDuplicateAdd bool
+	addCommentPrefix   string
+	annotateComments   bool
+	hideUnsignableKeys bool
+	ephemeralAddedKeys bool
+	auditLogger        *AuditLogger
+	lockScope          Scope
+	removeAllScope     Scope
+	signPreference     SignPreference
+	listOrder          ListOrder
+	addTargetPosition  int
+
+	allowRsaSha1Fallback bool
+	broadcastExtensions  map[string]bool
+	extensionModes       map[string]ExtensionMode
+	allowedKeyTypes      map[string]bool
+
+	version   string
+	revision  string
+	startedAt time.Time
+	clock     Clock
+
+	lockOpsLock    sync.Mutex // serialize Lock and Unlock including the calls to the agents
+	lockedLock     sync.Mutex // protect locked and passphraseHash
+	locked         bool
+	passphraseHash [sha256.Size]byte
+}
+
+var (
+	// ErrLocked is returned for operations refused while MuxAgent is locked
+	ErrLocked = errors.New("agent: locked")
+	// ErrNotLocked is returned for Unlock while MuxAgent is not locked
+	ErrNotLocked = errors.New("agent: not locked")
+	// ErrIncorrectPassphrase is returned for Unlock with a passphrase different from the one for Lock
+	ErrIncorrectPassphrase = errors.New("agent: incorrect passphrase")
+	// ErrNoSigner is returned for Sign when no agent holds the key
+	ErrNoSigner = errors.New("Not found for suitable signer")
+	// ErrKeyExists is returned for Add of a key already in the add-target when duplicates are rejected
+	ErrKeyExists = errors.New("the key already exists in the add-target agent")
+	// ErrKeyNotFound is returned when no agent holds the requested key
+	ErrKeyNotFound = errors.New("not found a key")
+	// ErrKeyTypeNotAllowed is returned for operations with a key of a type not allowed
+	ErrKeyTypeNotAllowed = errors.New("key type not allowed")
+	// ErrSessionBindRefused is returned for signing when the agent refused the session binds of the connection
+	ErrSessionBindRefused = errors.New("session bind refused")
+)
+
+// Scope selects the agents which an operation applies to
+type Scope string
+
+const (
+	ScopeAll        Scope = "all"
+	ScopeAddTargets Scope = "add_targets"
+	ScopeTargets    Scope = "targets"
+)
+
+// SignPreference decides which agent signs when multiple agents hold the same key
+type SignPreference string
+
+const (
+	SignPreferenceTargetsFirst    SignPreference = "targets_first"
+	SignPreferenceAddTargetsFirst SignPreference = "add_targets_first"
+)
+
+// ListOrder decides which agents' keys come first in List. Some clients try the first key by default.
+type ListOrder string
+
+const (
+	ListOrderTargetsFirst    ListOrder = "targets_first"
+	ListOrderAddTargetsFirst ListOrder = "add_targets_first"
+	// ListOrderAsConfigured lists the keys in the order the agents are configured.
+	// The add-target is placed at the position given by WithAddTargetPosition.
+	ListOrderAsConfigured ListOrder = "as_configured"
+)
+
+// ParseListOrder parses one of "targets_first", "add_targets_first" or "as_configured".
+func ParseListOrder(s string) (ListOrder, error) {
+	switch order := ListOrder(s); order {
+	case ListOrderTargetsFirst, ListOrderAddTargetsFirst, ListOrderAsConfigured:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown list order: %s", s)
+	}
+}
+
+// ExtensionMode decides how the responses of the agents to an extension are aggregated
+type ExtensionMode string
+
+const (
+	// ExtensionModeFirst returns the response of the first agent succeeded
+	ExtensionModeFirst ExtensionMode = "first"
+	// ExtensionModeAll sends the extension to all the agents and fails if any agent supporting it fails
+	// or the agents respond differently. It suits extensions changing the state of agents, whose
+	// responses don't depend on the agent.
+	ExtensionModeAll ExtensionMode = "all"
+)
+
+// ParseExtensionMode parses one of "first" or "all".
+func ParseExtensionMode(s string) (ExtensionMode, error) {
+	switch mode := ExtensionMode(s); mode {
+	case ExtensionModeFirst, ExtensionModeAll:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown extension mode: %s", s)
+	}
+}
+
+// ParseSignPreference parses one of "targets_first" or "add_targets_first".
+func ParseSignPreference(s string) (SignPreference, error) {
+	switch pref := SignPreference(s); pref {
+	case SignPreferenceTargetsFirst, SignPreferenceAddTargetsFirst:
+		return pref, nil
+	default:
+		return "", fmt.Errorf("unknown sign preference: %s", s)
+	}
+}
+
+// ParseScope parses one of "all", "add_targets" or "targets".
+func ParseScope(s string) (Scope, error) {
+	switch scope := Scope(s); scope {
+	case ScopeAll, ScopeAddTargets, ScopeTargets:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("unknown scope: %s", s)
+	}
+}
+
+// MuxAgentOption configures optional behaviors of MuxAgent
+type MuxAgentOption func(m *MuxAgent)
+
+// WithRejectDuplicateAdd makes Add refuse a key which already exists in the add-target agent.
+func WithRejectDuplicateAdd(reject bool) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.rejectDuplicateAdd = reject
+	}
+}
+
+// WithAuditLogger makes MuxAgent record every agent operation to l.
+func WithAuditLogger(l *AuditLogger) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.auditLogger = l
+	}
+}
+
+// WithLockScope limits the agents which Lock and Unlock apply to.
+func WithLockScope(scope Scope) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.lockScope = scope
+	}
+}
+
+// WithAllowRsaSha1Fallback makes SignWithFlags fall back to a plain ssh-rsa (SHA-1) signature
+// when the agent fails to sign an RSA key with rsa-sha2-256/512 requested.
+func WithAllowRsaSha1Fallback(allow bool) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.allowRsaSha1Fallback = allow
+	}
+}
+
+// WithBroadcastExtensions makes Extension send the extension types to all the agents.
+func WithBroadcastExtensions(extensionTypes []string) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.broadcastExtensions = map[string]bool{}
+		for _, t := range extensionTypes {
+			m.broadcastExtensions[t] = true
+		}
+	}
+}
+
+// WithExtensionModes sets ExtensionMode per extension type. ExtensionModeFirst is used for the others.
+func WithExtensionModes(modes map[string]ExtensionMode) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.extensionModes = modes
+	}
+}
+
+// WithVersion sets the version and the revision answered to VersionExtension.
+func WithVersion(version, revision string) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.version = version
+		m.revision = revision
+	}
+}
+
+// WithRemoveAllScope limits the agents which RemoveAll applies to.
+func WithRemoveAllScope(scope Scope) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.removeAllScope = scope
+	}
+}
+
+// WithAllowedKeyTypes hides keys of other types than keyTypes from List and refuses to sign with them.
+// Empty keyTypes allows all the key types.
+func WithAllowedKeyTypes(keyTypes []string) MuxAgentOption {
+	return func(m *MuxAgent) {
+		if len(keyTypes) == 0 {
+			m.allowedKeyTypes = nil
+			return
+		}
+		m.allowedKeyTypes = map[string]bool{}
+		for _, t := range keyTypes {
+			m.allowedKeyTypes[t] = true
+		}
+	}
 }
 
-func NewMuxAgent(targets []*Agent, addTarget *Agent) agent.Agent {
-	return &MuxAgent{
-		AddTarget: addTarget,
-		Targets:   targets,
+// WithAddCommentPrefix prepends prefix to the comment of keys added to the add-target.
+func WithAddCommentPrefix(prefix string) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.addCommentPrefix = prefix
+	}
+}
+
+// WithAnnotateComments appends " [via <label or path>]" to the comments of listed keys
+// so that clients can tell which agent holds each key.
+func WithAnnotateComments(annotate bool) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.annotateComments = annotate
+	}
+}
+
+// WithHideUnsignableKeys hides the keys from List which can't be parsed for signing.
+func WithHideUnsignableKeys(hide bool) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.hideUnsignableKeys = hide
+	}
+}
+
+// WithEphemeralAddedKeys removes the keys added on a client connection when the connection is closed.
+func WithEphemeralAddedKeys(ephemeral bool) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.ephemeralAddedKeys = ephemeral
+	}
+}
+
+// WithListOrder decides which agents' keys come first in List. Agents are ordered by priority first.
+func WithListOrder(order ListOrder) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.listOrder = order
+	}
+}
+
+// WithAddTargetPosition sets the number of targets configured before the add-target, which the as_configured list order follows.
+// A negative position places the add-target after all the targets.
+func WithAddTargetPosition(pos int) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.addTargetPosition = pos
+	}
+}
+
+// WithSignPreference decides which agent signs when multiple agents hold the same key.
+func WithSignPreference(pref SignPreference) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.signPreference = pref
+	}
+}
+
+// WithMuxClock replaces the clock used for the audit log and the status.
+func WithMuxClock(clock Clock) MuxAgentOption {
+	return func(m *MuxAgent) {
+		m.clock = clock
+	}
+}
+
+func NewMuxAgent(targets []*Agent, addTarget *Agent, opts ...MuxAgentOption) *MuxAgent {
+	m := &MuxAgent{
+		AddTarget:         addTarget,
+		Targets:           targets,
+		lockScope:         ScopeAll,
+		removeAllScope:    ScopeAddTargets,
+		signPreference:    SignPreferenceTargetsFirst,
+		listOrder:         ListOrderTargetsFirst,
+		addTargetPosition: -1,
+		clock:             RealClock{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.startedAt = m.clock.Now()
+	return m
+}
+
+// LogState logs a snapshot of the state of the agents for debugging.
+// It is safe to call while serving.
+func (m *MuxAgent) LogState() {
+	log.Info().Str("version", m.version).Bool("locked", m.isLocked()).Int("targets", len(m.Targets)).Msg("State of the multiplexer")
+	m.iterate(func(a *Agent) bool {
+		failures, open := a.breakerState()
+		logCtx := a.logger.With().
+			Bool("addTarget", a == m.AddTarget).
+			Int("priority", a.priority).
+			Bool("hidden", a.hidden).
+			Int("consecutiveFailures", failures).
+			Bool("breakerOpen", open)
+		keys, err := a.List()
+		if err != nil {
+			logCtx = logCtx.AnErr("listError", err)
+		} else {
+			logCtx = logCtx.Int("keys", len(keys))
+		}
+		logger := logCtx.Logger()
+		logger.Info().Msg("State of the agent")
+		return false
+	})
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return a.Type() == b.Type() && bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+func (m *MuxAgent) isLocked() bool {
+	m.lockedLock.Lock()
+	defer m.lockedLock.Unlock()
+	return m.locked
+}
+
+func (m *MuxAgent) keyTypeAllowed(keyType string) bool {
+	return m.allowedKeyTypes == nil || m.allowedKeyTypes[keyType]
+}
+
+func addedKeyPublicKey(key agent.AddedKey) (ssh.PublicKey, error) {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+// audit records the operation to the audit log if it is enabled.
+func (m *MuxAgent) audit(p *peer, method string, key ssh.PublicKey, path string, err error) {
+	if m.auditLogger == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:        m.clock.Now(),
+		Method:      method,
+		Fingerprint: fingerprint(key),
+		Path:        path,
+		Success:     err == nil,
+	}
+	if p != nil && p.credKnown {
+		r.PeerPid, r.PeerUid = &p.pid, &p.uid
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if werr := m.auditLogger.Write(r); werr != nil {
+		log.Error().Err(werr).Str("method", method).Msg("Failed to write an audit record")
 	}
 }
 
 // List implements agent.Agent
+// It returns the keys gathered from the agents succeeded. It fails only when all the agents failed.
 func (m *MuxAgent) List() ([]*agent.Key, error) {
+	return m.list(nil)
+}
+
+func (m *MuxAgent) list(p *peer) ([]*agent.Key, error) {
+	if m.isLocked() {
+		// a locked agent returns an empty list as [PROTOCOL.agent] says
+		m.audit(p, "List", nil, "", nil)
+		return []*agent.Key{}, nil
+	}
+
 	var err error
+	succeeded := false
 	keys := []*agent.Key{}
-	m.iterate(func(a *Agent) bool {
-		logger := log.With().Str("method", "List").Str("path", a.path).Logger()
-		_keys, err := a.List()
-		if err != nil {
-			logger.Error().Err(err).Msg("Failed to List keys")
-			return true
+	m.iterateListOrder(func(a *Agent) bool {
+		logger := p.logger(a.logger).With().Str("method", "List").Logger()
+		if a.hidden {
+			logger.Debug().Msg("Hid the keys of the hidden agent")
+			return false
+		}
+		_keys, _err := a.List()
+		if _err != nil {
+			logger.Error().Err(_err).Msg("Failed to List keys. Ignored")
+			err = _err
+			return false
+		}
+		succeeded = true
+		for _, k := range _keys {
+			if !m.keyTypeAllowed(k.Type()) {
+				logger.Debug().Str("keyType", k.Type()).Msg("Hid a key of disallowed type")
+				continue
+			}
+			if m.hideUnsignableKeys {
+				if _, err := ssh.ParsePublicKey(k.Blob); err != nil {
+					logger.Debug().Err(err).Str("fingerprint", ssh.FingerprintSHA256(k)).Msg("Hid a key which can't be used for signing")
+					continue
+				}
+			}
+			if m.annotateComments {
+				k.Comment = fmt.Sprintf("%s [via %s]", k.Comment, a.displayName())
+			}
+			keys = append(keys, k)
 		}
-		keys = append(keys, _keys...)
 		logger.Debug().Msgf("List() returns %d keys", len(_keys))
 		return false
 	})
+	if succeeded {
+		err = nil
+	}
+	m.audit(p, "List", nil, "", err)
 	if err != nil {
 		return nil, err
 	}
@@ -49,12 +460,33 @@ func (m *MuxAgent) List() ([]*agent.Key, error) {
 }
 
 // Lock implements agent.Agent
+// MuxAgent itself gets locked so that List returns an empty list and Sign, Add, Remove and RemoveAll fail
+// without hitting agents until Unlock with the same passphrase. Lock is also forwarded to agents in the lock scope.
 func (m *MuxAgent) Lock(passphrase []byte) error {
-	m.iterate(func(a *Agent) bool {
-		logger := log.With().Str("method", "Lock").Str("path", a.path).Logger()
+	return m.lock(nil, passphrase)
+}
+
+func (m *MuxAgent) lock(p *peer, passphrase []byte) (err error) {
+	defer func() { m.audit(p, "Lock", nil, "", err) }()
+
+	m.lockOpsLock.Lock()
+	defer m.lockOpsLock.Unlock()
+	m.lockedLock.Lock()
+	if m.locked {
+		m.lockedLock.Unlock()
+		return ErrLocked
+	}
+	m.locked = true
+	m.passphraseHash = sha256.Sum256(passphrase)
+	// the agents are locked after releasing lockedLock not to block the other operations while waiting for them
+	m.lockedLock.Unlock()
+
+	m.iterateScope(m.lockScope, func(a *Agent) bool {
+		logger := p.logger(a.logger).With().Str("method", "Lock").Logger()
 		err := a.Lock(passphrase)
 		if err != nil {
 			logger.Warn().Err(err).Msg("Failed to Lock. Ignored")
+			return false
 		}
 		logger.Debug().Msg("Lock succeeded")
 		return false
@@ -64,11 +496,34 @@ func (m *MuxAgent) Lock(passphrase []byte) error {
 
 // Unlock implements agent.Agent
 func (m *MuxAgent) Unlock(passphrase []byte) error {
-	m.iterate(func(a *Agent) bool {
-		logger := log.With().Str("method", "Unlock").Str("path", a.path).Logger()
+	return m.unlock(nil, passphrase)
+}
+
+func (m *MuxAgent) unlock(p *peer, passphrase []byte) (err error) {
+	defer func() { m.audit(p, "Unlock", nil, "", err) }()
+
+	m.lockOpsLock.Lock()
+	defer m.lockOpsLock.Unlock()
+	m.lockedLock.Lock()
+	if !m.locked {
+		m.lockedLock.Unlock()
+		return ErrNotLocked
+	}
+	hash := sha256.Sum256(passphrase)
+	if subtle.ConstantTimeCompare(hash[:], m.passphraseHash[:]) != 1 {
+		m.lockedLock.Unlock()
+		return ErrIncorrectPassphrase
+	}
+	m.locked = false
+	m.passphraseHash = [sha256.Size]byte{}
+	m.lockedLock.Unlock()
+
+	m.iterateScope(m.lockScope, func(a *Agent) bool {
+		logger := p.logger(a.logger).With().Str("method", "Unlock").Logger()
 		err := a.Unlock(passphrase)
 		if err != nil {
 			logger.Warn().Err(err).Msg("Failed to Unlock. Ignored")
+			return false
 		}
 		logger.Debug().Msg("UnLock succeeded")
 		return false
@@ -83,14 +538,45 @@ type publicKeyToAgent struct {
 
 // Sign implements agent.Agent
 func (m *MuxAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return m.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags implements agent.ExtendedAgent
+func (m *MuxAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return m.signWithFlags(nil, key, data, flags, nil)
+}
+
+// signWithFlags signs with the agent holding key. signer, if not nil, returns the agent to sign with in place of it.
+func (m *MuxAgent) signWithFlags(p *peer, key ssh.PublicKey, data []byte, flags agent.SignatureFlags, signer func(a *Agent) *Agent) (_ *ssh.Signature, err error) {
+	path := ""
+	defer func() { m.audit(p, "Sign", key, path, err) }()
+
+	if m.isLocked() {
+		return nil, ErrLocked
+	}
+
+	if !m.keyTypeAllowed(key.Type()) {
+		p.logger(log.Logger).Warn().Str("method", "Sign").Str("keyType", key.Type()).Msg("Refused to sign with a key of disallowed type")
+		return nil, fmt.Errorf("%w: %s", ErrKeyTypeNotAllowed, key.Type())
+	}
+
 	mapping, err := m.publicKeyToAgentMapping()
 	if err != nil {
 		return nil, err
 	}
 	for _, e := range mapping {
-		logger := log.With().Str("method", "Sign").Str("path", e.agt.path).Logger()
-		if e.pk.Type() == key.Type() && bytes.Equal(e.pk.Marshal(), key.Marshal()) {
-			signature, err := e.agt.Sign(key, data)
+		logger := p.logger(e.agt.logger).With().Str("method", "Sign").Logger()
+		if keysEqual(e.pk, key) {
+			path = e.agt.path
+			agt := e.agt
+			if signer != nil {
+				agt = signer(e.agt)
+			}
+			signature, err := agt.SignWithFlags(key, data, flags)
+			if err != nil && refusedByAgent(err) && m.allowRsaSha1Fallback && key.Type() == ssh.KeyAlgoRSA && flags&(agent.SignatureFlagRsaSha256|agent.SignatureFlagRsaSha512) != 0 {
+				logger.Warn().Err(err).Msg("Failed to sign with rsa-sha2. Falling back to ssh-rsa (SHA-1)")
+				signature, err = agt.Sign(key, data)
+			}
 			if err != nil {
 				logger.Error().Err(err).Msg("Failed to sign")
 				return nil, err
@@ -99,16 +585,26 @@ func (m *MuxAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error)
 			return signature, nil
 		}
 	}
-	return nil, errors.New("Not found for suitable signer")
+	return nil, ErrNoSigner
+}
+
+// refusedByAgent reports whether err is the agent refusing the request,
+// not a failure to deliver it (e.g. connection errors, timeouts or the open circuit breaker).
+func refusedByAgent(err error) bool {
+	return !isConnectionError(err) &&
+		!errors.Is(err, ErrOpTimeout) &&
+		!errors.Is(err, ErrBreakerOpen) &&
+		!errors.Is(err, ErrSessionBindRefused)
 }
 
 func (m *MuxAgent) publicKeyToAgentMapping() ([]publicKeyToAgent, error) {
 	pkToAgents := []publicKeyToAgent{}
 	var err error
-	m.iterate(func(a *Agent) bool {
+	m.iterateSignOrder(func(a *Agent) bool {
 		signers, err := a.Signers()
 		if err != nil {
-			return true
+			a.logger.Debug().Err(err).Msg("Failed to get Signers. Skipped")
+			return false
 		}
 		for _, signer := range signers {
 			pkToAgents = append(pkToAgents, publicKeyToAgent{
@@ -129,7 +625,7 @@ func (m *MuxAgent) Signers() ([]ssh.Signer, error) {
 	signers := []ssh.Signer{}
 	var err error
 	m.iterate(func(a *Agent) bool {
-		logger := log.With().Str("method", "Signers").Str("path", a.path).Logger()
+		logger := a.logger.With().Str("method", "Signers").Logger()
 		_signers, err := a.Signers()
 		if err != nil {
 			logger.Error().Err(err).Msg("Failed to get Signers")
@@ -146,7 +642,59 @@ func (m *MuxAgent) Signers() ([]ssh.Signer, error) {
 }
 
 func (m *MuxAgent) iterate(f func(a *Agent) bool) {
-	for _, aux := range append(m.Targets, m.AddTarget) {
+	m.iterateScope(ScopeAll, f)
+}
+
+func (m *MuxAgent) iterateScope(scope Scope, f func(a *Agent) bool) {
+	switch scope {
+	case ScopeAddTargets:
+		iterateAgents([]*Agent{m.AddTarget}, f)
+	case ScopeTargets:
+		iterateAgents(m.Targets, f)
+	default:
+		iterateAgents(append(append([]*Agent{}, m.Targets...), m.AddTarget), f)
+	}
+}
+
+// iterateSignOrder iterates all the agents in the order of the sign preference.
+// Sign applies to the first agent holding the key.
+func (m *MuxAgent) iterateSignOrder(f func(a *Agent) bool) {
+	if m.signPreference == SignPreferenceAddTargetsFirst {
+		m.iterateAddTargetsFirst(f)
+		return
+	}
+	m.iterate(f)
+}
+
+// iterateListOrder iterates all the agents in the order of the keys listed.
+func (m *MuxAgent) iterateListOrder(f func(a *Agent) bool) {
+	switch m.listOrder {
+	case ListOrderAddTargetsFirst:
+		m.iterateAddTargetsFirst(f)
+	case ListOrderAsConfigured:
+		pos := m.addTargetPosition
+		if pos < 0 || pos > len(m.Targets) {
+			pos = len(m.Targets)
+		}
+		agents := append(append([]*Agent{}, m.Targets[:pos]...), m.AddTarget)
+		iterateAgents(append(agents, m.Targets[pos:]...), f)
+	default:
+		m.iterate(f)
+	}
+}
+
+func (m *MuxAgent) iterateAddTargetsFirst(f func(a *Agent) bool) {
+	iterateAgents(append([]*Agent{m.AddTarget}, m.Targets...), f)
+}
+
+// iterateAgents iterates agents in ascending order of their priorities.
+// Agents with the same priority keep the given order.
+func iterateAgents(agents []*Agent, f func(a *Agent) bool) {
+	sorted := append([]*Agent{}, agents...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority < sorted[j].priority
+	})
+	for _, aux := range sorted {
 		if stop := f(aux); stop {
 			return
 		}
@@ -155,11 +703,39 @@ func (m *MuxAgent) iterate(f func(a *Agent) bool) {
 
 // Add implements agent.Agent
 func (m *MuxAgent) Add(key agent.AddedKey) error {
-	logger := log.With().Str("method", "Add").Str("path", m.AddTarget.path).Logger()
+	return m.add(nil, key)
+}
+
+func (m *MuxAgent) add(p *peer, key agent.AddedKey) (err error) {
+	logger := p.logger(m.AddTarget.logger).With().Str("method", "Add").Logger()
+	defer func() {
+		pk, _ := addedKeyPublicKey(key)
+		m.audit(p, "Add", pk, m.AddTarget.path, err)
+	}()
+
+	if m.isLocked() {
+		return ErrLocked
+	}
+
+	if m.rejectDuplicateAdd {
+		exists, err := m.existsInAddTarget(key)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to check the key already exists")
+			return err
+		}
+		if exists {
+			logger.Warn().Msg("The key already exists in the add-target. Rejected")
+			return ErrKeyExists
+		}
+	}
 
-	err := m.AddTarget.Add(key)
+	key.Comment = m.addCommentPrefix + key.Comment
+	err = m.AddTarget.Add(key)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to add a key")
+		if hasConstraintExtension(key, RestrictDestinationConstraint) {
+			return fmt.Errorf("the add-target agent failed to add the key with destination constraints (%s), which it may not support: %w", RestrictDestinationConstraint, err)
+		}
 		return err
 	}
 
@@ -167,32 +743,88 @@ func (m *MuxAgent) Add(key agent.AddedKey) error {
 	return nil
 }
 
+func hasConstraintExtension(key agent.AddedKey, name string) bool {
+	for _, e := range key.ConstraintExtensions {
+		if e.ExtensionName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MuxAgent) existsInAddTarget(key agent.AddedKey) (bool, error) {
+	pk, err := addedKeyPublicKey(key)
+	if err != nil {
+		return false, err
+	}
+	keys, err := m.AddTarget.List()
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if keysEqual(k, pk) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Remove implements agent.Agent
+// It removes the key from all the agents holding it.
 func (m *MuxAgent) Remove(key ssh.PublicKey) error {
+	return m.remove(nil, key)
+}
+
+func (m *MuxAgent) remove(p *peer, key ssh.PublicKey) (err error) {
+	paths := []string{}
+	defer func() { m.audit(p, "Remove", key, strings.Join(paths, ","), err) }()
+
+	if m.isLocked() {
+		return ErrLocked
+	}
+
 	mapping, err := m.publicKeyToAgentMapping()
 	if err != nil {
 		return err
 	}
+	errs := []string{}
 	for _, e := range mapping {
-		logger := log.With().Str("method", "Remove").Str("path", e.agt.path).Logger()
-		if e.pk.Type() == key.Type() && bytes.Equal(e.pk.Marshal(), key.Marshal()) {
-			err := e.agt.Remove(key)
-			if err != nil {
-				logger.Error().Err(err).Msg("Failed to remove a key")
-				return err
-			}
-			logger.Debug().Msg("Removed a key")
-			return nil
+		if !keysEqual(e.pk, key) {
+			continue
 		}
+		logger := p.logger(e.agt.logger).With().Str("method", "Remove").Logger()
+		paths = append(paths, e.agt.path)
+		if err := e.agt.Remove(key); err != nil {
+			logger.Error().Err(err).Msg("Failed to remove a key")
+			errs = append(errs, fmt.Sprintf("%s: %s", e.agt.path, err))
+			continue
+		}
+		logger.Debug().Msg("Removed a key")
+	}
+	if len(paths) == 0 {
+		p.logger(log.Logger).Warn().Str("method", "Remove").Msg("Not found a key to remove. Ignored")
+		return nil
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove the key: %s", strings.Join(errs, ", "))
 	}
-	log.Warn().Str("method", "Remove").Msg("Not found a key to remove. Ignored")
 	return nil
 }
 
 // RemoveAll implements agent.Agent
+// It removes all keys only in the add-target by default so that keys in shared targets are kept.
 func (m *MuxAgent) RemoveAll() error {
-	m.iterate(func(a *Agent) bool {
-		logger := log.With().Str("method", "RemoveAll").Str("path", a.path).Logger()
+	return m.removeAll(nil)
+}
+
+func (m *MuxAgent) removeAll(p *peer) (err error) {
+	defer func() { m.audit(p, "RemoveAll", nil, "", err) }()
+
+	if m.isLocked() {
+		return ErrLocked
+	}
+	m.iterateScope(m.removeAllScope, func(a *Agent) bool {
+		logger := p.logger(a.logger).With().Str("method", "RemoveAll").Logger()
 		err := a.RemoveAll()
 		if err != nil {
 			logger.Warn().Err(err).Msg("Failed to remove all keys. Ignored")
@@ -203,3 +835,122 @@ func (m *MuxAgent) RemoveAll() error {
 	})
 	return nil
 }
+
+// Extension implements agent.ExtendedAgent
+// VersionExtension is answered by MuxAgent itself. Broadcast extensions are sent to all the agents
+// and succeed if any agent succeeds. Extensions in ExtensionModeAll are sent to all the agents and
+// succeed if all the agents supporting them succeed with the same response.
+// The others are forwarded to agents and the first successful response is returned.
+func (m *MuxAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return m.extension(nil, extensionType, contents)
+}
+
+func (m *MuxAgent) extension(p *peer, extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case VersionExtension:
+		return m.versionExtension(), nil
+	case RemoveByFingerprintExtension:
+		return m.removeByFingerprint(p, contents)
+	case StatusExtension:
+		return m.statusExtension()
+	}
+
+	all := m.extensionModes[extensionType] == ExtensionModeAll
+	broadcast := all || m.broadcastExtensions[extensionType]
+	var ret []byte
+	succeeded := false
+	errs := []string{}
+	m.iterate(func(a *Agent) bool {
+		logger := p.logger(a.logger).With().Str("method", "Extension").Str("extensionType", extensionType).Logger()
+		res, err := a.Extension(extensionType, contents)
+		if err != nil {
+			if err != agent.ErrExtensionUnsupported {
+				logger.Debug().Err(err).Msg("Extension failed")
+				errs = append(errs, fmt.Sprintf("%s: %s", a.path, err))
+			}
+			return false
+		}
+		logger.Debug().Msg("Extension succeeded")
+		if !succeeded {
+			ret = res
+			succeeded = true
+		} else if all && !bytes.Equal(ret, res) {
+			errs = append(errs, fmt.Sprintf("%s: responded differently from the other agents", a.path))
+		}
+		return !broadcast
+	})
+	switch {
+	case succeeded && (!all || len(errs) == 0):
+		return ret, nil
+	case len(errs) > 0:
+		return nil, fmt.Errorf("extension %s failed: %s", extensionType, strings.Join(errs, ", "))
+	default:
+		return nil, agent.ErrExtensionUnsupported
+	}
+}
+
+// removeByFingerprint handles RemoveByFingerprintExtension.
+// contents is the fingerprint (e.g. "SHA256:...") encoded as an SSH string.
+func (m *MuxAgent) removeByFingerprint(p *peer, contents []byte) ([]byte, error) {
+	var req struct {
+		Fingerprint string
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, fmt.Errorf("invalid %s request: %w", RemoveByFingerprintExtension, err)
+	}
+
+	mapping, err := m.publicKeyToAgentMapping()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range mapping {
+		if ssh.FingerprintSHA256(e.pk) == req.Fingerprint {
+			if err := m.remove(p, e.pk); err != nil {
+				return nil, err
+			}
+			return []byte{agentSuccess}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w with fingerprint %s", ErrKeyNotFound, req.Fingerprint)
+}
+
+// Status is the payload of StatusExtension.
+type Status struct {
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Targets       int       `json:"targets"`
+	AddTargets    int       `json:"add_targets"`
+	Locked        bool      `json:"locked"`
+}
+
+func (m *MuxAgent) statusExtension() ([]byte, error) {
+	status, err := json.Marshal(Status{
+		Version:       m.version,
+		StartedAt:     m.startedAt,
+		UptimeSeconds: int64(m.clock.Now().Sub(m.startedAt).Seconds()),
+		Targets:       len(m.Targets),
+		AddTargets:    1,
+		Locked:        m.isLocked(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload := ssh.Marshal(struct {
+		Status string
+	}{
+		Status: string(status),
+	})
+	return append([]byte{agentSuccess}, payload...), nil
+}
+
+func (m *MuxAgent) versionExtension() []byte {
+	payload := ssh.Marshal(struct {
+		Version  string
+		Revision string
+	}{
+		Version:  m.version,
+		Revision: m.revision,
+	})
+	return append([]byte{agentSuccess}, payload...)
+}
@@ -0,0 +1,955 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestMuxAgentServesWithTargetDownAtStart(t *testing.T) {
+	up := newFakeAgent()
+	newTestKey(t, up, "up")
+	upAgent := newTestAgent(t, startFakeAgent(t, up))
+	downAgent, err := NewAgent(filepath.Join(tempDir(t), "down.sock"), WithRetry(1, 0))
+	if err == nil {
+		t.Fatal("expected an error for the agent not listening")
+	}
+	addTarget := newTestAgent(t, startFakeAgent(t, newFakeAgent()))
+
+	m := NewMuxAgent([]*Agent{upAgent, downAgent}, addTarget)
+	keys, err := m.List()
+	if err != nil {
+		t.Fatalf("expected List to succeed without the down target, got %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "up" {
+		t.Fatalf("expected the key of the target up, got %v", keys)
+	}
+}
+
+func TestMuxAgentListReturnsKeysOfSucceededAgents(t *testing.T) {
+	broken := newFakeAgent()
+	broken.list = func() ([]*agent.Key, error) {
+		return nil, errors.New("broken")
+	}
+	up := newFakeAgent()
+	newTestKey(t, up, "up")
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, broken)), newTestAgent(t, startFakeAgent(t, up))},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+	)
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatalf("expected List to tolerate the broken agent, got %v", err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "up" {
+		t.Fatalf("expected the key of the agent up, got %v", keys)
+	}
+}
+
+func TestMuxAgentListFailsWhenAllAgentsFail(t *testing.T) {
+	newBroken := func() *Agent {
+		broken := newFakeAgent()
+		broken.list = func() ([]*agent.Key, error) {
+			return nil, errors.New("broken")
+		}
+		return newTestAgent(t, startFakeAgent(t, broken))
+	}
+	m := NewMuxAgent([]*Agent{newBroken()}, newBroken())
+
+	if keys, err := m.List(); err == nil {
+		t.Fatalf("expected an error when all agents fail, got %v", keys)
+	}
+}
+
+func TestMuxAgentRemoveAllDefaultsToAddTarget(t *testing.T) {
+	target := newFakeAgent()
+	newTestKey(t, target, "read-only")
+	addTarget := newFakeAgent()
+	newTestKey(t, addTarget, "added")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, addTarget)))
+
+	if err := m.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n := target.callCount("RemoveAll"); n != 0 {
+		t.Errorf("expected the target untouched, got %d RemoveAll", n)
+	}
+	if keys, _ := target.List(); len(keys) != 1 {
+		t.Errorf("expected the key of the target kept, got %v", keys)
+	}
+	if keys, _ := addTarget.List(); len(keys) != 0 {
+		t.Errorf("expected the keys of the add-target removed, got %v", keys)
+	}
+}
+
+func TestMuxAgentRemoveAllScopes(t *testing.T) {
+	tests := []struct {
+		scope               Scope
+		wantTarget, wantAdd int
+	}{
+		{ScopeAll, 1, 1},
+		{ScopeTargets, 1, 0},
+		{ScopeAddTargets, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			target, addTarget := newFakeAgent(), newFakeAgent()
+			m := NewMuxAgent(
+				[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+				newTestAgent(t, startFakeAgent(t, addTarget)),
+				WithRemoveAllScope(tt.scope),
+			)
+			if err := m.RemoveAll(); err != nil {
+				t.Fatal(err)
+			}
+			if n := target.callCount("RemoveAll"); n != tt.wantTarget {
+				t.Errorf("expected %d RemoveAll to the target, got %d", tt.wantTarget, n)
+			}
+			if n := addTarget.callCount("RemoveAll"); n != tt.wantAdd {
+				t.Errorf("expected %d RemoveAll to the add-target, got %d", tt.wantAdd, n)
+			}
+		})
+	}
+}
+
+// extensionAgent returns a fake agent answering extensions with res, or failing with err.
+func extensionAgent(res []byte, err error) *fakeAgent {
+	f := newFakeAgent()
+	f.extension = func(extensionType string, contents []byte) ([]byte, error) {
+		return res, err
+	}
+	return f
+}
+
+func TestMuxAgentExtensionFirstMode(t *testing.T) {
+	unsupported := extensionAgent(nil, agent.ErrExtensionUnsupported)
+	first := extensionAgent([]byte{agentSuccess, 1}, nil)
+	second := extensionAgent([]byte{agentSuccess, 2}, nil)
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, unsupported)), newTestAgent(t, startFakeAgent(t, first))},
+		newTestAgent(t, startFakeAgent(t, second)),
+	)
+
+	res, err := m.Extension("test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, []byte{agentSuccess, 1}) {
+		t.Errorf("expected the response of the first agent succeeded, got %v", res)
+	}
+	if n := second.callCount("Extension"); n != 0 {
+		t.Errorf("expected no request after the first success, got %d", n)
+	}
+}
+
+func TestMuxAgentVersionExtension(t *testing.T) {
+	upstream := extensionAgent([]byte{agentSuccess, 1}, nil)
+	m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, upstream)), WithVersion("v1.2.3", "abcdef"))
+
+	res, err := m.Extension(VersionExtension, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 || res[0] != agentSuccess {
+		t.Fatalf("expected a success response, got %v", res)
+	}
+	var version struct {
+		Version  string
+		Revision string
+	}
+	if err := ssh.Unmarshal(res[1:], &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "v1.2.3" || version.Revision != "abcdef" {
+		t.Errorf("expected v1.2.3 (abcdef), got %+v", version)
+	}
+	if n := upstream.callCount("Extension"); n != 0 {
+		t.Errorf("expected the version extension answered without the upstream, got %d requests", n)
+	}
+
+	if res, err := m.Extension("test@example.com", nil); err != nil || !bytes.Equal(res, []byte{agentSuccess, 1}) {
+		t.Errorf("expected the other extension forwarded to the upstream, got %v, %v", res, err)
+	}
+	if n := upstream.callCount("Extension"); n != 1 {
+		t.Errorf("expected the other extension forwarded once, got %d requests", n)
+	}
+}
+
+func TestMuxAgentBroadcastExtension(t *testing.T) {
+	failing := extensionAgent(nil, errors.New("failed"))
+	first := extensionAgent([]byte{agentSuccess, 1}, nil)
+	second := extensionAgent([]byte{agentSuccess, 2}, nil)
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, failing)), newTestAgent(t, startFakeAgent(t, first))},
+		newTestAgent(t, startFakeAgent(t, second)),
+		WithBroadcastExtensions([]string{"broadcast@example.com"}),
+	)
+
+	if _, err := m.Extension("broadcast@example.com", nil); err != nil {
+		t.Fatalf("expected success when any agent succeeds, got %v", err)
+	}
+	for name, a := range map[string]*fakeAgent{"failing": failing, "first": first, "second": second} {
+		if n := a.callCount("Extension"); n != 1 {
+			t.Errorf("expected the broadcast extension sent to the %s agent once, got %d", name, n)
+		}
+	}
+
+	if _, err := m.Extension("test@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := second.callCount("Extension"); n != 1 {
+		t.Errorf("expected the other extension not to reach the agent after the first success, got %d requests", n)
+	}
+}
+
+func TestMuxAgentExtensionAllMode(t *testing.T) {
+	modes := map[string]ExtensionMode{"test@example.com": ExtensionModeAll}
+
+	t.Run("all supporting agents succeed", func(t *testing.T) {
+		unsupported := extensionAgent(nil, agent.ErrExtensionUnsupported)
+		first := extensionAgent([]byte{agentSuccess, 1}, nil)
+		second := extensionAgent([]byte{agentSuccess, 1}, nil)
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, unsupported)), newTestAgent(t, startFakeAgent(t, first))},
+			newTestAgent(t, startFakeAgent(t, second)),
+			WithExtensionModes(modes),
+		)
+		res, err := m.Extension("test@example.com", nil)
+		if err != nil {
+			t.Fatalf("expected success ignoring the unsupporting agent, got %v", err)
+		}
+		if !bytes.Equal(res, []byte{agentSuccess, 1}) {
+			t.Errorf("expected the response of the first agent succeeded, got %v", res)
+		}
+		if n := second.callCount("Extension"); n != 1 {
+			t.Errorf("expected the extension sent to all the agents, got %d requests to the last one", n)
+		}
+	})
+
+	t.Run("supporting agents respond differently", func(t *testing.T) {
+		first := extensionAgent([]byte{agentSuccess, 1}, nil)
+		second := extensionAgent([]byte{agentSuccess, 2}, nil)
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, first))},
+			newTestAgent(t, startFakeAgent(t, second)),
+			WithExtensionModes(modes),
+		)
+		if res, err := m.Extension("test@example.com", nil); err == nil {
+			t.Fatalf("expected an error for the different responses, got %v", res)
+		}
+	})
+
+	t.Run("a supporting agent fails", func(t *testing.T) {
+		succeeding := extensionAgent([]byte{agentSuccess, 1}, nil)
+		failing := extensionAgent(nil, errors.New("failed"))
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, succeeding))},
+			newTestAgent(t, startFakeAgent(t, failing)),
+			WithExtensionModes(modes),
+		)
+		if _, err := m.Extension("test@example.com", nil); err == nil {
+			t.Fatal("expected an error when a supporting agent fails")
+		}
+	})
+
+	t.Run("no agent supports it", func(t *testing.T) {
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, extensionAgent(nil, agent.ErrExtensionUnsupported)))},
+			newTestAgent(t, startFakeAgent(t, extensionAgent(nil, agent.ErrExtensionUnsupported))),
+			WithExtensionModes(modes),
+		)
+		if _, err := m.Extension("test@example.com", nil); err != agent.ErrExtensionUnsupported {
+			t.Fatalf("expected ErrExtensionUnsupported, got %v", err)
+		}
+	})
+}
+
+// rsaSha2RefusingAgent returns a fake agent holding an RSA key which refuses rsa-sha2 signatures.
+func rsaSha2RefusingAgent(t *testing.T) (*fakeAgent, ssh.PublicKey) {
+	f := newFakeAgent()
+	key := newTestRSAKey(t, f, "rsa")
+	f.signWithFlags = func(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+		if flags != 0 {
+			return nil, errors.New("rsa-sha2 not supported")
+		}
+		return f.ExtendedAgent.Sign(key, data)
+	}
+	return f, key
+}
+
+func TestMuxAgentRsaSha1Fallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		fallback  bool
+		wantErr   bool
+		wantSigns int
+	}{
+		{"enabled", true, false, 2},
+		{"disabled", false, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, key := rsaSha2RefusingAgent(t)
+			m := NewMuxAgent(
+				[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+				newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+				WithAllowRsaSha1Fallback(tt.fallback),
+			)
+			sig, err := m.SignWithFlags(key, []byte("data"), agent.SignatureFlagRsaSha256)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && sig.Format != ssh.KeyAlgoRSA {
+				t.Errorf("expected a ssh-rsa signature, got %s", sig.Format)
+			}
+			if n := target.callCount("Sign"); n != tt.wantSigns {
+				t.Errorf("expected %d sign requests, got %d", tt.wantSigns, n)
+			}
+		})
+	}
+}
+
+func TestMuxAgentRsaSha1FallbackSkipsTimedOutAgent(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	target, key := rsaSha2RefusingAgent(t)
+	target.signWithFlags = func(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+		<-release
+		return nil, errors.New("released")
+	}
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, target), WithOpTimeout(50*time.Millisecond))},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+		WithAllowRsaSha1Fallback(true),
+	)
+	_, err := m.SignWithFlags(key, []byte("data"), agent.SignatureFlagRsaSha256)
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected ErrOpTimeout, got %v", err)
+	}
+	if n := target.callCount("Sign"); n != 1 {
+		t.Errorf("expected no fallback for the timed out agent, got %d sign requests", n)
+	}
+}
+
+func TestMuxAgentListOrder(t *testing.T) {
+	newAgentWithKey := func(comment string) *Agent {
+		a := newFakeAgent()
+		newTestKey(t, a, comment)
+		return newTestAgent(t, startFakeAgent(t, a))
+	}
+	targets := []*Agent{newAgentWithKey("target1"), newAgentWithKey("target2")}
+	addTarget := newAgentWithKey("add")
+
+	for _, tc := range []struct {
+		order    ListOrder
+		opts     []MuxAgentOption
+		comments []string
+	}{
+		{order: ListOrderTargetsFirst, comments: []string{"target1", "target2", "add"}},
+		{order: ListOrderAddTargetsFirst, comments: []string{"add", "target1", "target2"}},
+		{order: ListOrderAsConfigured, opts: []MuxAgentOption{WithAddTargetPosition(1)}, comments: []string{"target1", "add", "target2"}},
+		{order: ListOrderAsConfigured, opts: []MuxAgentOption{WithAddTargetPosition(0)}, comments: []string{"add", "target1", "target2"}},
+		{order: ListOrderAsConfigured, comments: []string{"target1", "target2", "add"}},
+	} {
+		m := NewMuxAgent(targets, addTarget, append(tc.opts, WithListOrder(tc.order))...)
+		keys, err := m.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments := []string{}
+		for _, k := range keys {
+			comments = append(comments, k.Comment)
+		}
+		if strings.Join(comments, ",") != strings.Join(tc.comments, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.order, tc.comments, comments)
+		}
+	}
+}
+
+func TestParseListOrder(t *testing.T) {
+	for _, s := range []string{"targets_first", "add_targets_first", "as_configured"} {
+		if order, err := ParseListOrder(s); err != nil || string(order) != s {
+			t.Errorf("expected %s to be parsed, got %q, %v", s, order, err)
+		}
+	}
+	if _, err := ParseListOrder("unknown"); err == nil {
+		t.Error("expected an error for an unknown list order")
+	}
+}
+
+func TestMuxAgentServesLockedStateWhileLockingAgents(t *testing.T) {
+	locking, release := make(chan struct{}), make(chan struct{})
+	target := newFakeAgent()
+	target.lock = func(passphrase []byte) error {
+		close(locking)
+		<-release
+		return target.ExtendedAgent.Lock(passphrase)
+	}
+	key := newTestKey(t, target, "target")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	lockErr := make(chan error, 1)
+	go func() { lockErr <- m.Lock([]byte("passphrase")) }()
+	<-locking
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if keys, err := m.List(); err != nil || len(keys) != 0 {
+			t.Errorf("expected an empty list while locked, got %v, %v", keys, err)
+		}
+		if _, err := m.Sign(key, []byte("data")); !errors.Is(err, ErrLocked) {
+			t.Errorf("expected ErrLocked for Sign while locked, got %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("List and Sign were blocked while the agents were being locked")
+	}
+
+	close(release)
+	if err := <-lockErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unlock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := m.List(); err != nil || len(keys) != 1 {
+		t.Fatalf("expected the key listed after Unlock, got %v, %v", keys, err)
+	}
+}
+
+func TestMuxAgentAllowedKeyTypes(t *testing.T) {
+	target := newFakeAgent()
+	ed25519Key := newTestKey(t, target, "ed25519")
+	rsaKey := newTestRSAKey(t, target, "rsa")
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+		WithAllowedKeyTypes([]string{ssh.KeyAlgoED25519}),
+	)
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "ed25519" {
+		t.Fatalf("expected only the key of the allowed type listed, got %v", keys)
+	}
+	if _, err := m.Sign(ed25519Key, []byte("data")); err != nil {
+		t.Errorf("expected the key of the allowed type to sign, got %v", err)
+	}
+	_, err = m.Sign(rsaKey, []byte("data"))
+	if !errors.Is(err, ErrKeyTypeNotAllowed) {
+		t.Fatalf("expected ErrKeyTypeNotAllowed for the RSA key, got %v", err)
+	}
+	if want := "key type not allowed: " + ssh.KeyAlgoRSA; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+	if n := target.callCount("Sign"); n != 1 {
+		t.Errorf("expected the RSA key not forwarded to the target, got %d Sign calls", n)
+	}
+}
+
+func TestMuxAgentAllowsAllKeyTypesByDefault(t *testing.T) {
+	target := newFakeAgent()
+	newTestKey(t, target, "ed25519")
+	rsaKey := newTestRSAKey(t, target, "rsa")
+	m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	if keys, err := m.List(); err != nil || len(keys) != 2 {
+		t.Fatalf("expected all the keys listed, got %v, %v", keys, err)
+	}
+	if _, err := m.Sign(rsaKey, []byte("data")); err != nil {
+		t.Errorf("expected the RSA key to sign, got %v", err)
+	}
+}
+
+func TestMuxAgentReturnsSentinelErrors(t *testing.T) {
+	addTarget := newFakeAgent()
+	newTestKey(t, addTarget, "added")
+	m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, addTarget)), WithRejectDuplicateAdd(true))
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Sign(signer.PublicKey(), []byte("data")); !errors.Is(err, ErrNoSigner) {
+		t.Errorf("expected ErrNoSigner for Sign with an unknown key, got %v", err)
+	}
+	if err := m.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(agent.AddedKey{PrivateKey: priv}); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists for a duplicate Add, got %v", err)
+	}
+
+	if err := m.Unlock([]byte("passphrase")); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("expected ErrNotLocked for Unlock before Lock, got %v", err)
+	}
+	if err := m.Lock([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lock([]byte("passphrase")); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked for Lock while locked, got %v", err)
+	}
+	if err := m.Add(agent.AddedKey{PrivateKey: priv}); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked for Add while locked, got %v", err)
+	}
+	if err := m.Unlock([]byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("expected ErrIncorrectPassphrase for Unlock with a wrong passphrase, got %v", err)
+	}
+}
+
+func TestMuxAgentRemoveFromAllHolders(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHolder := func() *fakeAgent {
+		a := newFakeAgent()
+		if err := a.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	t.Run("all succeed", func(t *testing.T) {
+		target, addTarget := newHolder(), newHolder()
+		m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, addTarget)))
+		if err := m.Remove(signer.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		for name, a := range map[string]*fakeAgent{"target": target, "add-target": addTarget} {
+			if keys, _ := a.List(); len(keys) != 0 {
+				t.Errorf("expected the key removed from the %s, got %v", name, keys)
+			}
+		}
+	})
+
+	t.Run("one fails", func(t *testing.T) {
+		broken, addTarget := newHolder(), newHolder()
+		broken.remove = func(key ssh.PublicKey) error {
+			return errors.New("broken")
+		}
+		brokenPath := startFakeAgent(t, broken)
+		m := NewMuxAgent([]*Agent{newTestAgent(t, brokenPath)}, newTestAgent(t, startFakeAgent(t, addTarget)))
+		err := m.Remove(signer.PublicKey())
+		if err == nil || !strings.Contains(err.Error(), brokenPath) {
+			t.Fatalf("expected an error naming the failed agent %s, got %v", brokenPath, err)
+		}
+		if keys, _ := addTarget.List(); len(keys) != 0 {
+			t.Errorf("expected the key removed from the add-target despite the failure, got %v", keys)
+		}
+	})
+}
+
+func TestMuxAgentHiddenTargetSignsWithoutListing(t *testing.T) {
+	hidden := newFakeAgent()
+	hiddenKey := newTestKey(t, hidden, "hidden")
+	visible := newFakeAgent()
+	newTestKey(t, visible, "visible")
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, startFakeAgent(t, hidden), WithHidden(true)), newTestAgent(t, startFakeAgent(t, visible))},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+	)
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "visible" {
+		t.Fatalf("expected only the key of the visible target listed, got %v", keys)
+	}
+	data := []byte("data")
+	sig, err := m.Sign(hiddenKey, data)
+	if err != nil {
+		t.Fatalf("expected the hidden target to sign, got %v", err)
+	}
+	if err := hiddenKey.Verify(data, sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDuplicatedKeyAgents returns two fake agents holding the same key and its public key.
+func newDuplicatedKeyAgents(t *testing.T) (*fakeAgent, *fakeAgent, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := newFakeAgent(), newFakeAgent()
+	for _, a := range []*fakeAgent{first, second} {
+		if err := a.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return first, second, signer.PublicKey()
+}
+
+func TestMuxAgentSignPreference(t *testing.T) {
+	for _, tt := range []struct {
+		pref          SignPreference
+		wantAddTarget bool
+	}{
+		{SignPreferenceTargetsFirst, false},
+		{SignPreferenceAddTargetsFirst, true},
+	} {
+		target, addTarget, key := newDuplicatedKeyAgents(t)
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+			newTestAgent(t, startFakeAgent(t, addTarget)),
+			WithSignPreference(tt.pref),
+		)
+		if _, err := m.Sign(key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		signedByAddTarget := addTarget.callCount("Sign") == 1 && target.callCount("Sign") == 0
+		signedByTarget := target.callCount("Sign") == 1 && addTarget.callCount("Sign") == 0
+		if tt.wantAddTarget && !signedByAddTarget || !tt.wantAddTarget && !signedByTarget {
+			t.Errorf("%s: unexpected signer. target signed %d times, add-target signed %d times", tt.pref, target.callCount("Sign"), addTarget.callCount("Sign"))
+		}
+	}
+}
+
+func TestMuxAgentSignRoutesToLowerPriority(t *testing.T) {
+	first, second, key := newDuplicatedKeyAgents(t)
+	m := NewMuxAgent(
+		[]*Agent{
+			newTestAgent(t, startFakeAgent(t, first), WithPriority(10)),
+			newTestAgent(t, startFakeAgent(t, second), WithPriority(-1)),
+		},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+	)
+	if _, err := m.Sign(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if first.callCount("Sign") != 0 || second.callCount("Sign") != 1 {
+		t.Errorf("expected the agent with the lower priority to sign, got %d and %d Sign calls", first.callCount("Sign"), second.callCount("Sign"))
+	}
+}
+
+func TestMuxAgentRemoveByFingerprint(t *testing.T) {
+	target := newFakeAgent()
+	newTestKey(t, target, "kept")
+	removed := newTestKey(t, target, "removed")
+	addTarget := newFakeAgent()
+	m := NewMuxAgent([]*Agent{newTestAgent(t, startFakeAgent(t, target))}, newTestAgent(t, startFakeAgent(t, addTarget)))
+	request := func(fp string) []byte {
+		return ssh.Marshal(struct{ Fingerprint string }{fp})
+	}
+
+	if _, err := m.Extension(RemoveByFingerprintExtension, request(ssh.FingerprintSHA256(removed))); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := target.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "kept" {
+		t.Errorf("expected only the key of the fingerprint removed from the holding agent, got %v", keys)
+	}
+	if n := addTarget.callCount("Remove"); n != 0 {
+		t.Errorf("expected no Remove to the agent not holding the key, got %d", n)
+	}
+
+	if _, err := m.Extension(RemoveByFingerprintExtension, request(ssh.FingerprintSHA256(removed))); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound for the fingerprint not held by any agent, got %v", err)
+	}
+}
+
+func TestMuxAgentLockScopes(t *testing.T) {
+	for _, tt := range []struct {
+		scope         Scope
+		wantTarget    int
+		wantAddTarget int
+	}{
+		{ScopeAll, 1, 1},
+		{ScopeAddTargets, 0, 1},
+		{ScopeTargets, 1, 0},
+	} {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			target, addTarget := newFakeAgent(), newFakeAgent()
+			m := NewMuxAgent(
+				[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+				newTestAgent(t, startFakeAgent(t, addTarget)),
+				WithLockScope(tt.scope),
+			)
+			if err := m.Lock([]byte("passphrase")); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Unlock([]byte("passphrase")); err != nil {
+				t.Fatal(err)
+			}
+			for _, method := range []string{"Lock", "Unlock"} {
+				if n := target.callCount(method); n != tt.wantTarget {
+					t.Errorf("expected %s called %d times on the target, got %d", method, tt.wantTarget, n)
+				}
+				if n := addTarget.callCount(method); n != tt.wantAddTarget {
+					t.Errorf("expected %s called %d times on the add-target, got %d", method, tt.wantAddTarget, n)
+				}
+			}
+		})
+	}
+}
+
+func TestMuxAgentRejectDuplicateAdd(t *testing.T) {
+	for _, reject := range []bool{true, false} {
+		existing, _ := newTestPrivateKey(t)
+		addTarget := newFakeAgent()
+		if err := addTarget.Add(agent.AddedKey{PrivateKey: existing}); err != nil {
+			t.Fatal(err)
+		}
+		m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, addTarget)), WithRejectDuplicateAdd(reject))
+
+		err := m.Add(agent.AddedKey{PrivateKey: existing})
+		if reject && !errors.Is(err, ErrKeyExists) {
+			t.Errorf("expected ErrKeyExists for the duplicate key, got %v", err)
+		}
+		if !reject && err != nil {
+			t.Errorf("expected the duplicate key accepted without reject-duplicate-add, got %v", err)
+		}
+
+		fresh, freshPub := newTestPrivateKey(t)
+		if err := m.Add(agent.AddedKey{PrivateKey: fresh}); err != nil {
+			t.Fatalf("expected the new key accepted, got %v", err)
+		}
+		keys, err := addTarget.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the keyring keeps both copies of the duplicate key when it is accepted
+		want := 3
+		if reject {
+			want = 2
+		}
+		if len(keys) != want || !keysEqual(keys[want-1], freshPub) {
+			t.Errorf("expected %d keys ending with the new key in the add-target, got %v", want, keys)
+		}
+	}
+}
+
+func TestMuxAgentAddCommentPrefix(t *testing.T) {
+	for _, prefix := range []string{"mux: ", ""} {
+		addTarget := newFakeAgent()
+		m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, addTarget)), WithAddCommentPrefix(prefix))
+		priv, _ := newTestPrivateKey(t)
+		if err := m.Add(agent.AddedKey{PrivateKey: priv, Comment: "laptop"}); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := addTarget.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := prefix + "laptop"; len(keys) != 1 || keys[0].Comment != want {
+			t.Errorf("expected the comment %q in the add-target, got %v", want, keys)
+		}
+	}
+}
+
+func TestMuxAgentAddExplainsUnsupportedDestinationConstraint(t *testing.T) {
+	addTarget := newFakeAgent()
+	addTarget.add = func(key agent.AddedKey) error {
+		return errors.New("refused")
+	}
+	m := NewMuxAgent(nil, newTestAgent(t, startFakeAgent(t, addTarget)))
+	priv, _ := newTestPrivateKey(t)
+
+	constrained := agent.AddedKey{
+		PrivateKey:           priv,
+		ConstraintExtensions: []agent.ConstraintExtension{{ExtensionName: RestrictDestinationConstraint}},
+	}
+	err := m.Add(constrained)
+	if err == nil || !strings.Contains(err.Error(), "destination constraints") {
+		t.Errorf("expected the error to explain the destination constraints, got %v", err)
+	}
+
+	err = m.Add(agent.AddedKey{PrivateKey: priv})
+	if err == nil || strings.Contains(err.Error(), "destination constraints") {
+		t.Errorf("expected the error of the add-target as is for an unconstrained key, got %v", err)
+	}
+}
+
+func TestMuxAgentAnnotateComments(t *testing.T) {
+	target, addTarget := newFakeAgent(), newFakeAgent()
+	newTestKey(t, target, "labeled")
+	newTestKey(t, addTarget, "unlabeled")
+	addTargetPath := startFakeAgent(t, addTarget)
+	targets := []*Agent{newTestAgent(t, startFakeAgent(t, target), WithLabel("work"))}
+
+	for _, tt := range []struct {
+		annotate bool
+		want     []string
+	}{
+		{true, []string{"labeled [via work]", "unlabeled [via " + addTargetPath + "]"}},
+		{false, []string{"labeled", "unlabeled"}},
+	} {
+		m := NewMuxAgent(targets, newTestAgent(t, addTargetPath), WithAnnotateComments(tt.annotate))
+		keys, err := m.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments := []string{}
+		for _, k := range keys {
+			comments = append(comments, k.Comment)
+		}
+		if strings.Join(comments, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("annotate=%v: expected %v, got %v", tt.annotate, tt.want, comments)
+		}
+		if _, err := m.Sign(keys[0], []byte("data")); err != nil {
+			t.Errorf("annotate=%v: expected the listed key to sign, got %v", tt.annotate, err)
+		}
+	}
+	if n := target.callCount("Sign"); n != 2 {
+		t.Errorf("expected the target to sign the listed key twice, got %d", n)
+	}
+}
+
+// unsignableKeyAgent returns a fake agent listing a valid key and a key whose blob can't be parsed for signing.
+func unsignableKeyAgent(t *testing.T) (*fakeAgent, ssh.PublicKey) {
+	t.Helper()
+	f := newFakeAgent()
+	valid := newTestKey(t, f, "valid")
+	broken := &agent.Key{
+		Format:  ssh.KeyAlgoED25519,
+		Blob:    ssh.Marshal(struct{ Format, Rest string }{ssh.KeyAlgoED25519, "broken"}),
+		Comment: "broken",
+	}
+	f.list = func() ([]*agent.Key, error) {
+		keys, err := f.ExtendedAgent.List()
+		return append(keys, broken), err
+	}
+	return f, valid
+}
+
+func TestMuxAgentUnsignableKeys(t *testing.T) {
+	for _, hide := range []bool{true, false} {
+		logs := captureLogs(t)
+		target, valid := unsignableKeyAgent(t)
+		m := NewMuxAgent(
+			[]*Agent{newTestAgent(t, startFakeAgent(t, target))},
+			newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+			WithHideUnsignableKeys(hide),
+		)
+
+		keys, err := m.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "valid,broken"
+		if hide {
+			want = "valid"
+		}
+		comments := []string{}
+		for _, k := range keys {
+			comments = append(comments, k.Comment)
+		}
+		if strings.Join(comments, ",") != want {
+			t.Errorf("hide=%v: expected the keys %s listed, got %v", hide, want, comments)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := m.Sign(valid, []byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := len(logs.messages(t, "The listed key can't be used for signing. Skipped")); n != 1 {
+			t.Errorf("hide=%v: expected the unsignable key warned once, got %d warnings", hide, n)
+		}
+	}
+}
+
+func TestMuxAgentSignReconnectsAgentDroppedAfterList(t *testing.T) {
+	target := newFakeAgent()
+	key := newTestKey(t, target, "target")
+	path, accepted := startDroppableFakeAgent(t, target)
+	m := NewMuxAgent([]*Agent{newTestAgent(t, path)}, newTestAgent(t, startFakeAgent(t, newFakeAgent())))
+
+	if keys, err := m.List(); err != nil || len(keys) != 1 {
+		t.Fatalf("expected the key listed, got %v, %v", keys, err)
+	}
+	// the upstream drops the connection between List and Sign
+	_ = (<-accepted).Close()
+
+	data := []byte("data")
+	sig, err := m.Sign(key, data)
+	if err != nil {
+		t.Fatalf("expected Sign to reconnect the dropped agent, got %v", err)
+	}
+	if err := key.Verify(data, sig); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	default:
+		t.Error("expected a new connection to the dropped agent")
+	}
+}
+
+func TestMuxAgentLogState(t *testing.T) {
+	logs := captureLogs(t)
+	target := newFakeAgent()
+	newTestKey(t, target, "target")
+	targetPath := startFakeAgent(t, target)
+	m := NewMuxAgent(
+		[]*Agent{newTestAgent(t, targetPath, WithLabel("work"), WithPriority(2))},
+		newTestAgent(t, startFakeAgent(t, newFakeAgent())),
+		WithVersion("v1.2.3", "abcdef"),
+	)
+
+	m.LogState()
+	mux := logs.messages(t, "State of the multiplexer")
+	if len(mux) != 1 || mux[0]["version"] != "v1.2.3" || mux[0]["locked"] != false || mux[0]["targets"] != float64(1) {
+		t.Errorf("expected the state of the multiplexer logged once, got %v", mux)
+	}
+	agents := logs.messages(t, "State of the agent")
+	if len(agents) != 2 {
+		t.Fatalf("expected the states of the 2 agents logged, got %v", agents)
+	}
+	// the add-target is logged first as its priority is lower
+	addTargetState, targetState := agents[0], agents[1]
+	want := map[string]interface{}{
+		"path":                targetPath,
+		"label":               "work",
+		"addTarget":           false,
+		"priority":            float64(2),
+		"hidden":              false,
+		"consecutiveFailures": float64(0),
+		"breakerOpen":         false,
+		"keys":                float64(1),
+	}
+	for field, v := range want {
+		if targetState[field] != v {
+			t.Errorf("expected %s=%v in the state of the target, got %v", field, v, targetState[field])
+		}
+	}
+	if addTargetState["addTarget"] != true || addTargetState["keys"] != float64(0) {
+		t.Errorf("expected the state of the add-target, got %v", addTargetState)
+	}
+}
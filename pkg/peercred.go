@@ -0,0 +1,34 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrPeerCredUnsupported is returned by PeerCred on platforms or connections without peer credentials
+var ErrPeerCredUnsupported = errors.New("peer credentials are not supported")
+
+// PeerCred returns the pid and the uid of the process on the other side of the unix socket connection.
+func PeerCred(conn net.Conn) (pid, uid int, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %T", ErrPeerCredUnsupported, conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		pid, uid, credErr = peerCred(fd)
+	}); err != nil {
+		return 0, 0, err
+	}
+	return pid, uid, credErr
+}
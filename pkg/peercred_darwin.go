@@ -0,0 +1,23 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build darwin
+
+package pkg
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func peerCred(fd uintptr) (pid, uid int, err error) {
+	cred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, 0, err
+	}
+	pid, err = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pid, int(cred.Uid), nil
+}
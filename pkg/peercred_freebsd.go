@@ -0,0 +1,25 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build freebsd
+
+package pkg
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func peerCred(fd uintptr) (pid, uid int, err error) {
+	cred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the last field of xucred is the union holding cr_pid, which x/sys doesn't expose.
+	// it is filled since FreeBSD 13.
+	pidOffset := unsafe.Sizeof(*cred) - unsafe.Sizeof(uintptr(0))
+	pid = int(*(*int32)(unsafe.Add(unsafe.Pointer(cred), pidOffset)))
+	return pid, int(cred.Uid), nil
+}
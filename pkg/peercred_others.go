@@ -0,0 +1,11 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !linux && !darwin && !freebsd
+
+package pkg
+
+func peerCred(fd uintptr) (pid, uid int, err error) {
+	return 0, 0, ErrPeerCredUnsupported
+}
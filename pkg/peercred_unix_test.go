@@ -0,0 +1,50 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build darwin || linux
+
+package pkg
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPeerCredOfSocketpair(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := []net.Conn{}
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		conns = append(conns, conn)
+	}
+
+	pid, uid, err := PeerCred(conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() || uid != os.Getuid() {
+		t.Errorf("expected the pid %d and the uid %d of this process, got %d and %d", os.Getpid(), os.Getuid(), pid, uid)
+	}
+}
+
+func TestPeerCredUnsupportedConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if _, _, err := PeerCred(server); !errors.Is(err, ErrPeerCredUnsupported) {
+		t.Errorf("expected ErrPeerCredUnsupported for a pipe, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package pkg
+
+import "strings"
+
+// IsAbstractSocket reports whether path names a Linux abstract socket, which has no file.
+func IsAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
@@ -0,0 +1,13 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !linux
+
+package pkg
+
+// IsAbstractSocket reports whether path names a Linux abstract socket.
+// Abstract sockets are only available on Linux, where a path starting with '@' is an ordinary file elsewhere.
+func IsAbstractSocket(path string) bool {
+	return false
+}
@@ -0,0 +1,102 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// watchReconnectAttempts is the number of attempts to connect to a recreated socket
+	watchReconnectAttempts = 5
+	// watchReconnectBackoff is the initial backoff between the attempts. It doubles on every attempt.
+	watchReconnectBackoff = 50 * time.Millisecond
+)
+
+// WatchAgents watches the directories of the agents' sockets and reconnects an agent
+// as soon as its socket is (re)created, e.g. when the backing agent restarted.
+// It blocks until ctx is done.
+func WatchAgents(ctx context.Context, agents []*Agent) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	agentsByPath := map[string]*Agent{}
+	for _, a := range agents {
+		if IsAbstractSocket(a.path) {
+			// abstract sockets have no file to watch
+			continue
+		}
+		p, err := filepath.Abs(a.path)
+		if err != nil {
+			return err
+		}
+		if err := watcher.Add(filepath.Dir(p)); err != nil {
+			a.logger.Warn().Err(err).Msg("Failed to watch the directory of the agent socket. The agent will be reconnected on demand")
+			continue
+		}
+		agentsByPath[p] = a
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn().Err(err).Msg("Error in watching target agent sockets")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) {
+				continue
+			}
+			p, err := filepath.Abs(event.Name)
+			if err != nil {
+				continue
+			}
+			a, found := agentsByPath[p]
+			if !found {
+				continue
+			}
+			go reconnectRecreated(ctx, a)
+		}
+	}
+}
+
+// reconnectRecreated connects a whose socket was recreated with backoff.
+// The socket file appears when the agent binds it, which may be before the agent starts listening on it.
+func reconnectRecreated(ctx context.Context, a *Agent) {
+	backoff := watchReconnectBackoff
+	for try := 1; ; try++ {
+		err := a.connect()
+		if err == nil {
+			a.logger.Info().Msg("Reconnected the agent whose socket was recreated")
+			return
+		}
+		if try >= watchReconnectAttempts {
+			a.logger.Warn().Err(err).Int("attempts", try).Msg("Failed to reconnect the agent whose socket was recreated. It will be reconnected on demand")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,21 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !darwin && !dragonfly && !freebsd && !openbsd && !linux && !netbsd && !solaris && !windows
+
+package pkg
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// WatchAgents only waits for ctx to be done because fsnotify doesn't support this platform.
+// The agents are reconnected on demand.
+func WatchAgents(ctx context.Context, agents []*Agent) error {
+	log.Debug().Msg("Watching target agent sockets is not supported on this platform. They will be reconnected on demand")
+	<-ctx.Done()
+	return nil
+}
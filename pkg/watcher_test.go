@@ -0,0 +1,50 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build darwin || dragonfly || freebsd || openbsd || linux || netbsd || solaris || windows
+
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchAgentsConnectsAgentWhenSocketIsCreated(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.sock")
+	a, err := NewAgent(path)
+	if err == nil {
+		t.Fatal("expected an error for the agent not listening yet")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		_ = WatchAgents(ctx, []*Agent{a})
+	}()
+	// give the watcher time to start watching the directory
+	time.Sleep(100 * time.Millisecond)
+
+	serveFakeAgentAt(t, path, newFakeAgent())
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		a.lock.Lock()
+		connected := a.agent != nil
+		a.lock.Unlock()
+		if connected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the agent was not connected after its socket was created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build darwin || linux
+
+package pkg
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestWatchAgentsRetriesSocketCreatedBeforeListening(t *testing.T) {
+	path := filepath.Join(tempDir(t), "agent.sock")
+	clock := newFakeClock()
+	a, err := NewAgent(path, WithClock(clock))
+	if err == nil {
+		t.Fatal("expected an error for the agent not listening yet")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		_ = WatchAgents(ctx, []*Agent{a})
+	}()
+	// give the watcher time to start watching the directory
+	time.Sleep(100 * time.Millisecond)
+
+	// bind creates the socket file, but connecting to it is refused until listen
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		_ = syscall.Close(fd)
+		t.Fatal(err)
+	}
+	clock.waitForWaiters(t, 1)
+
+	if err := syscall.Listen(fd, 1); err != nil {
+		_ = syscall.Close(fd)
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	l, err := net.FileListener(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(newFakeAgent(), c)
+			}()
+		}
+	}()
+	clock.Advance(watchReconnectBackoff)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		a.lock.Lock()
+		connected := a.agent != nil
+		a.lock.Unlock()
+		if connected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the agent was not connected after its socket started listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+const (
+	// rejectDelay is the delay before closing a rejected connection to slow down clients retrying eagerly
+	rejectDelay = 100 * time.Millisecond
+
+	// backoff for consecutive accept errors (e.g. EMFILE) not to spin
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = 1 * time.Second
+	// consecutive accept errors logged as errors instead of warnings
+	acceptErrorsToEscalate = 5
+)
+
+// serveOptions configures how serve accepts and serves client connections
+type serveOptions struct {
+	// maxConcurrentConns limits the number of connections served concurrently. 0 means no limit.
+	maxConcurrentConns int
+	// rejectConnsWhenFull rejects new connections instead of waiting when maxConcurrentConns is reached
+	rejectConnsWhenFull bool
+	// clientIdleTimeout closes connections idle longer than it. 0 means no timeout.
+	clientIdleTimeout time.Duration
+}
+
+// serve accepts client connections on l and serves agt on them until ctx is done.
+// When ctx is done, it closes the client connections and waits for them to finish.
+func serve(ctx context.Context, l net.Listener, agt *pkg.MuxAgent, opts serveOptions) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// sem limits the number of connections served concurrently. nil means no limit.
+	var sem chan struct{}
+	if opts.maxConcurrentConns > 0 {
+		sem = make(chan struct{}, opts.maxConcurrentConns)
+	}
+
+	acceptErrors := 0
+	acceptBackoff := minAcceptBackoff
+	for {
+		if sem != nil && !opts.rejectConnsWhenFull {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		c, err := l.Accept()
+		if err != nil {
+			if sem != nil && !opts.rejectConnsWhenFull {
+				<-sem
+			}
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("Failed to listen")
+				return
+			}
+			acceptErrors++
+			logEvent := log.Warn()
+			if acceptErrors >= acceptErrorsToEscalate {
+				logEvent = log.Error()
+			}
+			logEvent.Err(err).Int("consecutiveErrors", acceptErrors).Dur("backoff", acceptBackoff).Msg("Failed to accept. Retrying")
+			select {
+			case <-time.After(acceptBackoff):
+			case <-ctx.Done():
+				return
+			}
+			acceptBackoff *= 2
+			if acceptBackoff > maxAcceptBackoff {
+				acceptBackoff = maxAcceptBackoff
+			}
+			continue
+		}
+		acceptErrors = 0
+		acceptBackoff = minAcceptBackoff
+		if sem != nil && opts.rejectConnsWhenFull {
+			select {
+			case sem <- struct{}{}:
+			default:
+				log.Warn().Int("maxConcurrentConns", opts.maxConcurrentConns).Msg("Too many concurrent connections. Rejected")
+				go func() {
+					time.Sleep(rejectDelay)
+					_ = c.Close()
+				}()
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+			}()
+			serveConn(ctx, c, agt, opts.clientIdleTimeout)
+		}()
+	}
+}
+
+// newConnID returns a short random ID to correlate the logs of a client connection.
+func newConnID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// serveConn serves agt on c until the client closes it, it is idle longer than idleTimeout or ctx is done.
+func serveConn(ctx context.Context, c net.Conn, agt *pkg.MuxAgent, idleTimeout time.Duration) {
+	defer c.Close()
+	connID := newConnID()
+	logger := log.With().Str("connID", connID).Logger()
+	logger.Debug().Msg("Accepted a client connection")
+
+	// close the connection on shutdown to unblock serving it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-done:
+		}
+	}()
+
+	connAgt := agt.ForConnection(c, connID)
+	defer func() {
+		_ = c.Close()
+		if err := connAgt.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to clean up the client connection")
+		}
+	}()
+	err := agent.ServeAgent(connAgt, pkg.WithIdleTimeout(c, idleTimeout))
+	switch {
+	case err == nil || err == io.EOF:
+		logger.Debug().Msg("Closed the client connection")
+	case ctx.Err() != nil:
+		logger.Debug().Msg("Closed the client connection on shutdown")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Debug().Dur("clientIdleTimeout", idleTimeout).Msg("Closed the idle client connection")
+	default:
+		logger.Error().Err(err).Msg("Error in serving agent")
+	}
+}
@@ -0,0 +1,429 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+// fakeListener fails the first errs Accepts and returns the connections sent to conns after that.
+type fakeListener struct {
+	conns chan net.Conn
+
+	mu      sync.Mutex
+	errs    int
+	accepts []time.Time
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeListener(errs int) *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), errs: errs, closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts = append(l.accepts, time.Now())
+	if l.errs > 0 {
+		l.errs--
+		l.mu.Unlock()
+		return nil, errors.New("accept: too many open files")
+	}
+	l.mu.Unlock()
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "fake", Net: "unix"}
+}
+
+func (l *fakeListener) acceptTimes() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time{}, l.accepts...)
+}
+
+// waitFor polls cond until it holds or fails the test after a while.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeBacksOffOnAcceptErrors(t *testing.T) {
+	const errs = 4
+	l := newFakeListener(errs)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, l, nil, serveOptions{})
+	}()
+
+	waitFor(t, "accepts after the errors", func() bool { return len(l.acceptTimes()) == errs+1 })
+	cancel()
+	_ = l.Close()
+	<-done
+
+	accepts := l.acceptTimes()
+	if len(accepts) != errs+1 {
+		t.Fatalf("expected %d accepts, got %d", errs+1, len(accepts))
+	}
+	backoff := minAcceptBackoff
+	for i := 1; i < len(accepts); i++ {
+		if gap := accepts[i].Sub(accepts[i-1]); gap < backoff {
+			t.Errorf("expected accept %d after backoff %v, got %v", i+1, backoff, gap)
+		}
+		backoff *= 2
+	}
+}
+
+// testDir returns a short temporary directory so that socket paths fit in sockaddr_un.
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// startUpstream serves a on a new unix socket and returns its path.
+func startUpstream(t *testing.T, a agent.Agent) string {
+	t.Helper()
+	path := filepath.Join(testDir(t), "upstream.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(a, c)
+			}()
+		}
+	}()
+	return path
+}
+
+// newTestMux returns a MuxAgent with upstream as the add-target.
+func newTestMux(t *testing.T, upstream agent.Agent) *pkg.MuxAgent {
+	t.Helper()
+	addTarget, err := pkg.NewAgent(startUpstream(t, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg.NewMuxAgent(nil, addTarget)
+}
+
+// countingListener counts the accepted connections not closed yet.
+type countingListener struct {
+	net.Listener
+	active, max int32
+}
+
+type countingConn struct {
+	net.Conn
+	l    *countingListener
+	once sync.Once
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	active := atomic.AddInt32(&l.active, 1)
+	for {
+		max := atomic.LoadInt32(&l.max)
+		if active <= max || atomic.CompareAndSwapInt32(&l.max, max, active) {
+			break
+		}
+	}
+	return &countingConn{Conn: c, l: l}, nil
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.l.active, -1) })
+	return c.Conn.Close()
+}
+
+// startServe serves agt on a new unix socket with opts until the test ends. It returns the path of the socket.
+func startServe(t *testing.T, agt *pkg.MuxAgent, opts serveOptions) (string, *countingListener) {
+	t.Helper()
+	path := filepath.Join(testDir(t), "mux.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, cl, agt, opts)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		_ = l.Close()
+		<-done
+	})
+	return path, cl
+}
+
+// slowAgent is a keyring whose List takes delay.
+type slowAgent struct {
+	agent.Agent
+	delay time.Duration
+}
+
+func (a *slowAgent) List() ([]*agent.Key, error) {
+	time.Sleep(a.delay)
+	return a.Agent.List()
+}
+
+func listVia(path string) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = agent.NewClient(c).List()
+	return err
+}
+
+func TestServeCapsConcurrentConns(t *testing.T) {
+	agt := newTestMux(t, &slowAgent{Agent: agent.NewKeyring(), delay: 20 * time.Millisecond})
+	path, l := startServe(t, agt, serveOptions{maxConcurrentConns: 2})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- listVia(path)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected clients over the limit to wait, got %v", err)
+		}
+	}
+	if max := atomic.LoadInt32(&l.max); max != 2 {
+		t.Errorf("expected at most 2 connections served concurrently, got %d", max)
+	}
+}
+
+func TestServeRejectsConnsWhenFull(t *testing.T) {
+	agt := newTestMux(t, agent.NewKeyring())
+	path, l := startServe(t, agt, serveOptions{maxConcurrentConns: 1, rejectConnsWhenFull: true})
+
+	held, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	waitFor(t, "the held connection to be accepted", func() bool { return atomic.LoadInt32(&l.active) == 1 })
+
+	if err := listVia(path); err == nil {
+		t.Fatal("expected the connection over the limit to be rejected")
+	}
+	_ = held.Close()
+	waitFor(t, "the held connection to be released", func() bool { return atomic.LoadInt32(&l.active) == 0 })
+	if err := listVia(path); err != nil {
+		t.Fatalf("expected the connection after releasing to be served, got %v", err)
+	}
+}
+
+func TestServeClosesIdleConns(t *testing.T) {
+	agt := newTestMux(t, &slowAgent{Agent: agent.NewKeyring(), delay: 150 * time.Millisecond})
+	path, _ := startServe(t, agt, serveOptions{clientIdleTimeout: 50 * time.Millisecond})
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// a request served longer than the timeout doesn't count as idle
+	if _, err := agent.NewClient(c).List(); err != nil {
+		t.Fatalf("expected the slow request to be served, got %v", err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the idle connection to be closed")
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected the idle connection to be closed by the server")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the connection closed after the idle timeout, got closed in %v", elapsed)
+	}
+}
+
+func TestServeReturnsOnShutdownWithOpenConns(t *testing.T) {
+	agt := newTestMux(t, agent.NewKeyring())
+	path := filepath.Join(testDir(t), "mux.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cl := &countingListener{Listener: l}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, cl, agt, serveOptions{})
+	}()
+
+	// a client keeping its connection open
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "the connection to be accepted", func() bool { return atomic.LoadInt32(&cl.active) == 1 })
+
+	cancel()
+	_ = l.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected serve to return on shutdown by closing the open connection")
+	}
+	if active := atomic.LoadInt32(&cl.active); active != 0 {
+		t.Errorf("expected the open connection closed, got %d active", active)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the JSON log lines written so far.
+func (b *syncBuffer) lines(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := []map[string]interface{}{}
+	for _, l := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if l == "" {
+			continue
+		}
+		line := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("invalid log line %q: %v", l, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// captureLogs redirects the global logger to the returned buffer at debug level until the test ends.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	return buf
+}
+
+func TestServeLogsConnID(t *testing.T) {
+	logs := captureLogs(t)
+	agt := newTestMux(t, agent.NewKeyring())
+	path, l := startServe(t, agt, serveOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := listVia(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the connections to be closed", func() bool { return atomic.LoadInt32(&l.active) == 0 })
+
+	accepted := map[string]bool{}
+	listed := map[string]bool{}
+	for _, line := range logs.lines(t) {
+		connID, _ := line["connID"].(string)
+		if line["message"] == "Accepted a client connection" {
+			accepted[connID] = true
+		}
+		if line["method"] == "List" {
+			if connID == "" {
+				t.Errorf("expected the List log line to carry the connection ID: %v", line)
+			}
+			listed[connID] = true
+		}
+	}
+	if len(accepted) != 2 || accepted[""] {
+		t.Fatalf("expected 2 connections with distinct IDs, got %v", accepted)
+	}
+	for connID := range accepted {
+		if !listed[connID] {
+			t.Errorf("expected List log lines of connection %s", connID)
+		}
+	}
+}
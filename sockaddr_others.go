@@ -0,0 +1,10 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+// maxSocketPathLen is the size of sun_path in sockaddr_un including the trailing NUL
+const maxSocketPathLen = 108
@@ -0,0 +1,16 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build !unix
+
+package main
+
+import (
+	"context"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+// handleStateDumpSignal does nothing since SIGUSR1 is not available on this platform.
+func handleStateDumpSignal(ctx context.Context, agt *pkg.MuxAgent) {}
@@ -0,0 +1,31 @@
+// Licensed to Shingo Omura under one or more agreements.
+// Shingo Omura licenses this file to you under the Apache 2.0 License.
+// See the LICENSE file in the project root for more information.
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/everpeace/ssh-agent-multiplexer/pkg"
+)
+
+// handleStateDumpSignal logs the state of agt on every SIGUSR1 until ctx is done.
+func handleStateDumpSignal(ctx context.Context, agt *pkg.MuxAgent) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			agt.LogState()
+		}
+	}
+}